@@ -0,0 +1,240 @@
+package minhashlsh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// The operations recorded in the log of an index file.
+const (
+	logAdd = iota + 1
+	logRemove
+)
+
+// IndexLog appends Add and Remove operations to an index file, i.e. a file
+// starting with an index written by Save, so a growing index is persisted
+// without rewriting it. OpenIndex loads the index and replays the
+// operations. The operations are buffered until Flush or Close.
+//
+// The log grows with every operation, including the removal of keys added
+// earlier, and replaying it is as slow as the operations themselves, so
+// once the log is large compared with the index, the file should be
+// compacted by CompactIndex, which rewrites it as a single index.
+type IndexLog struct {
+	file      *os.File
+	w         *bufio.Writer
+	bw        *binaryWriter
+	encodeKey func(interface{}) ([]byte, error)
+	// numHash is the number of hash functions of the index.
+	numHash int
+}
+
+// AppendToIndex opens the index file for appending operations, encoding
+// the keys with encodeKey, which must be the codec given to Save.
+// If encodeKey is nil, the default codec supporting only string and int
+// keys is used. The number of hash functions is read from the index, so
+// Add can check the signatures.
+func AppendToIndex(filename string, encodeKey func(interface{}) ([]byte, error)) (*IndexLog, error) {
+	if encodeKey == nil {
+		encodeKey = encodeDefaultKey
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, numHash, err := readHeader(newBinaryReader(bufio.NewReader(file), -1))
+	if err == nil && numHash > math.MaxInt32 {
+		err = errors.New("Incorrect MinhashLSH parameters")
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := bufio.NewWriter(file)
+	return &IndexLog{
+		file:      file,
+		w:         w,
+		bw:        &binaryWriter{w: w},
+		encodeKey: encodeKey,
+		numHash:   int(numHash),
+	}, nil
+}
+
+// Add appends the addition of a key with its signature. A signature
+// whose length is not the number of hash functions of the index is an
+// error, and nothing is appended, as OpenIndex would reject the file.
+// The keys are not checked for duplicates, which OpenIndex adds as the
+// duplicate policy of the index says, except that RejectDuplicateKeys
+// replaces the key.
+func (l *IndexLog) Add(key interface{}, sig []uint64) error {
+	if len(sig) != l.numHash {
+		return fmt.Errorf("Incorrect signature length %d of key %v, expected %d", len(sig), key, l.numHash)
+	}
+	if err := l.writeKey(logAdd, key); err != nil {
+		return err
+	}
+	l.bw.writeUvarint(uint64(len(sig)))
+	for _, v := range sig {
+		l.bw.writeUint64(v)
+	}
+	return l.bw.err
+}
+
+// Remove appends the removal of a key.
+func (l *IndexLog) Remove(key interface{}) error {
+	if err := l.writeKey(logRemove, key); err != nil {
+		return err
+	}
+	return l.bw.err
+}
+
+func (l *IndexLog) writeKey(op byte, key interface{}) error {
+	b, err := l.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	l.bw.write([]byte{op})
+	l.bw.writeUvarint(uint64(len(b)))
+	l.bw.write(b)
+	return nil
+}
+
+// Flush writes the buffered operations to the file.
+func (l *IndexLog) Flush() error {
+	if l.bw.err != nil {
+		return l.bw.err
+	}
+	return l.w.Flush()
+}
+
+// Close flushes the buffered operations and closes the file.
+func (l *IndexLog) Close() error {
+	err := l.Flush()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// OpenIndex loads the index of an index file and replays the operations
+// appended by IndexLog, so the index has all the keys added and not
+// removed since it was saved, and indexes them. decodeKey must be the
+// inverse of the encodeKey used, and if it is nil the default codec
+// supporting only string and int keys is used. If the index is created
+// with RejectDuplicateKeys, an operation adding a key already in the
+// index replaces it, as if it was removed first. A file whose last
+// operation is incomplete, e.g. as the process appending it was killed,
+// is an error.
+func OpenIndex(filename string, decodeKey func([]byte) (interface{}, error)) (*MinhashLSH, error) {
+	if decodeKey == nil {
+		decodeKey = decodeDefaultKey
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	f := new(MinhashLSH)
+	if err := f.decode(r, info.Size(), decodeKey); err != nil {
+		return nil, err
+	}
+	br := newBinaryReader(r, -1)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := decodeKey(br.read(int(br.readUvarint())))
+		if br.err != nil {
+			return nil, br.err
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case logAdd:
+			size := br.readUvarint()
+			if size != uint64(f.numHash) {
+				br.fail(fmt.Errorf("Incorrect signature length %d of key %v", size, key))
+			}
+			sig := make([]uint64, 0, f.numHash)
+			for j := uint64(0); j < size && br.err == nil; j++ {
+				sig = append(sig, br.readUint64())
+			}
+			if br.err != nil {
+				return nil, br.err
+			}
+			// IndexLog does not know the keys of the index, so a key
+			// added again replaces the previous one, even if the index
+			// rejects duplicate keys.
+			err := f.Add(key, sig)
+			if err == ErrDuplicateKey {
+				f.Remove(key)
+				err = f.Add(key, sig)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case logRemove:
+			f.Remove(key)
+		default:
+			return nil, errors.New("Incorrect index log operation")
+		}
+	}
+	f.Index()
+	return f, nil
+}
+
+// CompactIndex rewrites the index file as a single index without a log,
+// by loading it with OpenIndex and saving it with Save to a temporary
+// file in the same directory, which then replaces the index file with
+// the same permissions. The index file is unchanged if it fails. It must
+// not be called while the file is open by AppendToIndex.
+func CompactIndex(filename string, encodeKey func(interface{}) ([]byte, error),
+	decodeKey func([]byte) (interface{}, error)) error {
+	f, err := OpenIndex(filename, decodeKey)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".compact")
+	if err != nil {
+		return err
+	}
+	// TempFile creates the file with mode 0600, keep that of the index.
+	err = tmp.Chmod(info.Mode().Perm())
+	w := bufio.NewWriter(tmp)
+	if err == nil {
+		err = f.Save(w, encodeKey)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package minhashlsh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_AppendToIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minhashlsh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "index")
+
+	sig1, sig2, sig3 := randomSignature(256, 1), randomSignature(256, 2), randomSignature(256, 3)
+	f := NewMinhashLSH16(256, 0.6, 2)
+	f.Add("sig1", sig1)
+	f.Add(2, sig2)
+	f.Index()
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Save(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	log, err := AppendToIndex(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Add("sig3", sig3); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Add("sig1b", sig1); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Remove(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Add(struct{}{}, sig1); err == nil {
+		t.Fatal("expected error for unsupported key")
+	}
+	if err := log.Add("short", sig1[:255]); err == nil {
+		t.Fatal("expected error for incorrect signature length")
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(g *MinhashLSH) {
+		if results := g.Query(sig1); len(results) != 2 {
+			t.Fatal(results)
+		}
+		if results := g.Query(sig2); len(results) != 0 {
+			t.Fatal(results)
+		}
+		if results := g.Query(sig3); len(results) != 1 || results[0] != "sig3" {
+			t.Fatal(results)
+		}
+	}
+	g, err := OpenIndex(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(g)
+
+	if err := os.Chmod(filename, 0640); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(filename)
+	if err := CompactIndex(filename, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(filename)
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected a smaller file after compaction, got %d from %d bytes", after.Size(), before.Size())
+	}
+	if after.Mode() != before.Mode() {
+		t.Fatalf("expected mode %v after compaction, got %v", before.Mode(), after.Mode())
+	}
+	if g, err = OpenIndex(filename, nil); err != nil {
+		t.Fatal(err)
+	}
+	check(g)
+
+	// An incomplete last operation.
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err = AppendToIndex(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Add("sig4", randomSignature(256, 4))
+	log.Close()
+	full, _ := ioutil.ReadFile(filename)
+	if err := ioutil.WriteFile(filename, full[:len(data)+10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenIndex(filename, nil); err == nil {
+		t.Fatal("expected error for an incomplete operation")
+	}
+	if _, err := AppendToIndex(filepath.Join(dir, "missing"), nil); err == nil {
+		t.Fatal("expected error for a missing file")
+	}
+	if err := ioutil.WriteFile(filename, []byte("nope"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AppendToIndex(filename, nil); err == nil {
+		t.Fatal("expected error for a file without an index")
+	}
+}
+
+func Test_AppendToIndexDuplicateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minhashlsh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "index")
+
+	sig1, sig2 := randomSignature(256, 1), randomSignature(256, 2)
+	f := NewMinhashLSH16(256, 0.6, 1, DuplicateKeys(RejectDuplicateKeys))
+	f.Add("a", sig1)
+	f.Index()
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Save(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	log, err := AppendToIndex(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Add("a", sig2); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := OpenIndex(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig1); len(results) != 0 {
+		t.Fatal(results)
+	}
+	if results := g.Query(sig2); len(results) != 1 || results[0] != "a" {
+		t.Fatal(results)
+	}
+}
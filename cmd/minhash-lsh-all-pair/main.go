@@ -2,13 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	minhashlsh "github.com/ekzhu/minhash-lsh"
@@ -16,36 +24,168 @@ import (
 
 var (
 	setFilename    string
+	outputFilename string
 	minhashSeed    int64
+	seedFilename   string
 	minhashSize    int
 	threshold      float64
 	outputSelfPair bool
 	hasID          bool
+	dedup          bool
+	metric         string
+	numWorkers     int
+	shingleSize    int
+	mergeByID      bool
+	minSetSize     int
+	dryRun         bool
+	weighted       bool
+	estimate       float64
+	serveAddr      string
+	indexFilename  string
+	skipBadLines   bool
+	sortOutput     bool
+	dedupWindow    int
+)
+
+// The similarity metrics supported by -metric, each selects
+// the sketch used for the signatures and its LSH index.
+const (
+	metricJaccard = "jaccard"
 )
 
 func main() {
 	flag.StringVar(&setFilename, "input", "", "The set file as input")
+	flag.StringVar(&outputFilename, "output", "",
+		"The file to write results to, by default results are written to stdout")
 	flag.Int64Var(&minhashSeed, "seed", 42, "The Minhash seed")
+	flag.StringVar(&seedFilename, "seedfile", "",
+		"The file storing the Minhash hash function seeds, created from -seed if it does not exist")
 	flag.IntVar(&minhashSize, "sigsize", 128,
 		"The Minhash signature size in number of hash functions")
 	flag.Float64Var(&threshold, "threshold", 0.9, "The Jaccard similarity threshold")
 	flag.BoolVar(&outputSelfPair, "selfpair", false, "Allow self-pair in results")
 	flag.BoolVar(&hasID, "hasIDfield", true, "The input set file has ID field in the beginning of each line")
+	flag.BoolVar(&dedup, "dedup", false,
+		"Run as a streaming near-duplicate filter: report whether each set is a duplicate of an earlier set")
+	flag.StringVar(&metric, "metric", metricJaccard,
+		"The similarity metric, currently only jaccard (MinHash) is supported")
+	flag.IntVar(&numWorkers, "workers", 1, "The number of goroutines querying the index in parallel")
+	flag.IntVar(&shingleSize, "shingle", 1,
+		"Minhash shingles of this many consecutive values instead of individual values")
+	flag.BoolVar(&mergeByID, "merge-by-id", false,
+		"Union the sets of all lines with the same ID into a single set before indexing")
+	flag.IntVar(&minSetSize, "minsize", 0,
+		"Skip sets with fewer than this many values, whose signatures are unreliable")
+	flag.BoolVar(&dryRun, "dryrun", false,
+		"Count the sets and print the index parameters and estimated memory without building the index")
+	flag.BoolVar(&weighted, "weighted", false,
+		"Use the value frequencies as weights for the weighted Jaccard similarity")
+	flag.Float64Var(&estimate, "estimate", 0,
+		"Only estimate the number of pairs by querying this fraction of the sets, between 0 and 1")
+	flag.StringVar(&serveAddr, "serve", "",
+		"Build the index and serve queries on this TCP address, e.g. :8080, or unix:<path> for a Unix socket")
+	flag.StringVar(&indexFilename, "index", "",
+		"With -serve, load the index from this file, or build it from -input and save it there if it does not exist")
+	flag.BoolVar(&skipBadLines, "skip-bad-lines", false,
+		"Skip malformed lines of the set file, reporting them on stderr, instead of failing")
+	flag.BoolVar(&sortOutput, "sort", false,
+		"Buffer all the pairs and write them sorted by first then second ID, instead of streaming them")
+	flag.IntVar(&dedupWindow, "dedup-window", 1000000,
+		"With -dedup, compare every set with at least this number of sets before it, holding at most twice as many")
 	flag.Parse()
 
+	if metric != metricJaccard {
+		fmt.Fprintf(os.Stderr, "Unsupported similarity metric: %s\n", metric)
+		os.Exit(2)
+	}
+
+	if weighted && shingleSize > 1 {
+		fmt.Fprintln(os.Stderr, "Shingles are not supported with -weighted")
+		os.Exit(2)
+	}
+
+	if numWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "The -workers must be at least 1")
+		os.Exit(2)
+	}
+
+	if dedupWindow < 1 {
+		fmt.Fprintln(os.Stderr, "The -dedup-window must be at least 1")
+		os.Exit(2)
+	}
+
+	if estimate < 0 || estimate > 1 {
+		fmt.Fprintln(os.Stderr, "The -estimate fraction must be between 0 and 1")
+		os.Exit(2)
+	}
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run runs the mode selected by the flags, and returns the first error.
+func run() error {
+	if seedFilename != "" {
+		if err := loadOrSaveHasherSeeds(seedFilename); err != nil {
+			return err
+		}
+	} else {
+		hasherSeed1, hasherSeed2 = minhashlsh.HasherSeeds(minhashSeed)
+	}
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if outputFilename != "" {
+		var err error
+		if file, err = os.Create(outputFilename); err != nil {
+			return err
+		}
+		out = file
+	}
+
+	var err error
+	switch {
+	case dryRun:
+		err = printPlan(out)
+	case serveAddr != "":
+		err = serve(serveAddr)
+	case estimate > 0:
+		err = estimatePairs(out)
+	case dedup:
+		err = streamDedup(out)
+	default:
+		err = allPairs(out)
+	}
+	// An error closing the output file, e.g. of a full disk, loses results.
+	if file != nil {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// allPairs indexes all the sets and writes every pair of sets found
+// by querying the index with each set.
+func allPairs(out io.Writer) error {
 	// Create Minhash signatures
 	start := time.Now()
-	sets := readSets(setFilename, hasID)
+	sets, errc := readSets(setFilename, hasID)
 	setSigs := make([]setSig, 0)
 	for setSig := range createSigantures(sets) {
 		setSigs = append(setSigs, setSig)
 	}
+	if err := <-errc; err != nil {
+		return err
+	}
 	signatureCreationTime := time.Now().Sub(start)
 	fmt.Fprintf(os.Stderr, "Creating Minhash signature time: %.2f seconds\n", signatureCreationTime.Seconds())
 
-	// Indexing
+	// Indexing, the index is presized for all the signatures read.
 	start = time.Now()
-	lsh := minhashlsh.NewMinhashLSH(minhashSize, threshold, len(sets))
+	lsh := minhashlsh.NewMinhashLSH(minhashSize, threshold, len(setSigs))
 	for _, s := range setSigs {
 		lsh.Add(s.ID, s.signature)
 	}
@@ -55,31 +195,270 @@ func main() {
 
 	// Querying and output results
 	start = time.Now()
-	pairs := make(chan pair)
-	go func() {
-		defer close(pairs)
-		for _, s := range setSigs {
-			for _, candidateID := range lsh.Query(s.signature) {
-				if !outputSelfPair && candidateID == s.ID {
-					continue
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	// The workers send the pairs in batches, so the channel is not a
+	// bottleneck with millions of pairs, and can be ahead of the writer
+	// by a batch each before they block.
+	pairs := make(chan []pair, numWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		// Each worker queries every numWorkers-th set.
+		go func(w int) {
+			defer wg.Done()
+			batch := make([]pair, 0, pairBatchSize)
+			for i := w; i < len(setSigs); i += numWorkers {
+				s := setSigs[i]
+				var candidates []interface{}
+				if outputSelfPair {
+					candidates = lsh.Query(s.signature)
+				} else {
+					candidates = lsh.QueryExcluding(s.signature, s.ID)
+				}
+				for _, candidateID := range candidates {
+					batch = append(batch, pair{s.ID, candidateID.(string)})
+					if len(batch) == pairBatchSize {
+						pairs <- batch
+						batch = make([]pair, 0, pairBatchSize)
+					}
 				}
-				pairs <- pair{s.ID, candidateID.(string)}
 			}
-		}
+			if len(batch) > 0 {
+				pairs <- batch
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		close(pairs)
 	}()
-	w := bufio.NewWriter(os.Stdout)
-	for pair := range pairs {
-		w.WriteString(pair.String() + "\n")
+	// The writer writes the output out whenever its buffer is full, or
+	// with -sort, holds all the pairs until the search is done.
+	w := bufio.NewWriterSize(out, outputBufferSize)
+	var sorted pairOrder
+	for batch := range pairs {
+		for _, pair := range batch {
+			if sortOutput {
+				sorted = append(sorted, pair.normalized())
+			} else {
+				pair.writeTo(w)
+			}
+		}
+	}
+	sort.Sort(sorted)
+	for _, pair := range sorted {
+		pair.writeTo(w)
 	}
 	if err := w.Flush(); err != nil {
-		panic(err)
+		return err
 	}
 	searchTime := time.Now().Sub(start)
 	fmt.Fprintf(os.Stderr, "All pair search time: %.2f seconds\n", searchTime.Seconds())
+	return nil
+}
+
+// estimatePairs indexes all the sets like allPairs, but only queries a
+// random sample of the sets, and extrapolates the average number of
+// candidates of the sampled sets to an estimate of the number of pairs
+// that allPairs would write.
+func estimatePairs(out io.Writer) error {
+	sets, errc := readSets(setFilename, hasID)
+	setSigs := make([]setSig, 0)
+	for setSig := range createSigantures(sets) {
+		setSigs = append(setSigs, setSig)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	lsh := minhashlsh.NewMinhashLSH(minhashSize, threshold, len(setSigs))
+	for _, s := range setSigs {
+		lsh.Add(s.ID, s.signature)
+	}
+	lsh.Index()
+
+	rng := rand.New(rand.NewSource(minhashSeed))
+	var numSampled, numCandidates int
+	for _, s := range setSigs {
+		if rng.Float64() >= estimate {
+			continue
+		}
+		if outputSelfPair {
+			numCandidates += len(lsh.Query(s.signature))
+		} else {
+			numCandidates += len(lsh.QueryExcluding(s.signature, s.ID))
+		}
+		numSampled++
+	}
+	var numPairs float64
+	if numSampled > 0 {
+		numPairs = float64(numCandidates) / float64(numSampled) * float64(len(setSigs))
+	}
+	_, err := fmt.Fprintf(out, "Estimated %.0f pairs from %d of %d sets\n",
+		numPairs, numSampled, len(setSigs))
+	return err
+}
+
+// streamDedup reads the sets in a single pass. Each set is queried against
+// the sets seen before it, at least the last -dedup-window ones, reported
+// as either unique or a duplicate of the matching sets, and then added to
+// the index.
+func streamDedup(out io.Writer) error {
+	start := time.Now()
+	index := newDedupIndex(dedupWindow)
+	w := bufio.NewWriter(out)
+	var numSets, numDuplicates int
+	sets, errc := readSets(setFilename, hasID)
+	for s := range createSigantures(sets) {
+		IDs := index.query(s.signature)
+		if len(IDs) == 0 {
+			w.WriteString(s.ID + ", unique\n")
+		} else {
+			w.WriteString(s.ID + ", duplicate, " + strings.Join(IDs, " ") + "\n")
+			numDuplicates++
+		}
+		if err := index.add(s.ID, s.signature); err != nil {
+			return err
+		}
+		numSets++
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	dedupTime := time.Now().Sub(start)
+	fmt.Fprintf(os.Stderr, "Found %d duplicates in %d sets\n", numDuplicates, numSets)
+	fmt.Fprintf(os.Stderr, "Dedup time: %.2f seconds\n", dedupTime.Seconds())
+	return nil
 }
 
-func pointquery() {
-	panic("Not implemented")
+// The number of sets of streamDedup merged at once into its index.
+const dedupBatchSize = 1024
+
+// dedupIndex holds the recent sets of streamDedup in fixed memory. A set
+// is added to a small pending index, searchable right away, and the
+// pending sets are merged into the current index in batches, so the
+// current index is not sorted again for every set. Once the current
+// index has window sets, it replaces the previous index, whose sets are
+// forgotten, so every set is compared with at least the window sets
+// before it, and at most twice as many sets are held.
+type dedupIndex struct {
+	window      int
+	previous    *minhashlsh.MinhashLSH
+	current     *minhashlsh.MinhashLSH
+	numCurrent  int
+	pending     *minhashlsh.MinhashLSH
+	pendingIDs  []interface{}
+	pendingSigs [][]uint64
+}
+
+func newDedupIndex(window int) *dedupIndex {
+	return &dedupIndex{
+		window:  window,
+		current: minhashlsh.NewMinhashLSH(minhashSize, threshold, 0),
+		pending: minhashlsh.NewMinhashLSH(minhashSize, threshold, 0),
+	}
+}
+
+// query returns the sorted IDs of the sets held matching the signature.
+func (d *dedupIndex) query(sig []uint64) []string {
+	seen := make(map[string]bool)
+	for _, lsh := range []*minhashlsh.MinhashLSH{d.previous, d.current, d.pending} {
+		if lsh == nil {
+			continue
+		}
+		for _, candidateID := range lsh.Query(sig) {
+			seen[candidateID.(string)] = true
+		}
+	}
+	IDs := make([]string, 0, len(seen))
+	for ID := range seen {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+	return IDs
+}
+
+// add adds a set, merging the pending sets into the current index once
+// there are enough of them, and starting a new current index once it is
+// full.
+func (d *dedupIndex) add(ID string, sig []uint64) error {
+	// A single key is merged into the sorted pending index in linear time.
+	if err := d.pending.BuildSorted([]interface{}{ID}, [][]uint64{sig}); err != nil {
+		return err
+	}
+	d.pendingIDs = append(d.pendingIDs, ID)
+	d.pendingSigs = append(d.pendingSigs, sig)
+	if len(d.pendingIDs) < dedupBatchSize && d.numCurrent+len(d.pendingIDs) < d.window {
+		return nil
+	}
+	if err := d.current.BuildSorted(d.pendingIDs, d.pendingSigs); err != nil {
+		return err
+	}
+	d.numCurrent += len(d.pendingIDs)
+	d.pending = minhashlsh.NewMinhashLSH(minhashSize, threshold, 0)
+	d.pendingIDs, d.pendingSigs = nil, nil
+	if d.numCurrent >= d.window {
+		d.previous = d.current
+		d.current = minhashlsh.NewMinhashLSH(minhashSize, threshold, 0)
+		d.numCurrent = 0
+	}
+	return nil
+}
+
+// printPlan counts the sets that would be indexed, without computing
+// their signatures, and prints the parameters chosen for the index and
+// its estimated memory.
+func printPlan(out io.Writer) error {
+	var numSets int
+	// The sizes of the merged sets with -merge-by-id.
+	sizes := make(map[string]int)
+	sets, errc := readSets(setFilename, hasID)
+	for set := range sets {
+		if mergeByID {
+			sizes[set.ID] += len(set.values)
+		} else if len(set.values) >= minSetSize {
+			numSets++
+		}
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	for _, size := range sizes {
+		if size >= minSetSize {
+			numSets++
+		}
+	}
+	lsh := minhashlsh.NewMinhashLSH(minhashSize, threshold, 0)
+	_, err := fmt.Fprintf(out, "%d sets\n%s", numSets, lsh.ExplainParamsFor(numSets))
+	return err
+}
+
+// The seeds of the Minhash hash functions used for all signatures.
+var hasherSeed1, hasherSeed2 uint64
+
+// loadOrSaveHasherSeeds reads the Minhash hash function seeds from the
+// seed file, so signatures are reproducible on platforms where math/rand
+// derives different seeds from -seed. If the file does not exist,
+// the seeds are derived from -seed and written to it.
+func loadOrSaveHasherSeeds(seedFilename string) error {
+	file, err := os.Open(seedFilename)
+	if os.IsNotExist(err) {
+		hasherSeed1, hasherSeed2 = minhashlsh.HasherSeeds(minhashSeed)
+		content := fmt.Sprintf("%d %d\n", hasherSeed1, hasherSeed2)
+		return ioutil.WriteFile(seedFilename, []byte(content), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := fmt.Fscan(file, &hasherSeed1, &hasherSeed2); err != nil {
+		return errors.New("Incorrect seed file " + seedFilename + ": " + err.Error())
+	}
+	return nil
 }
 
 type valueCountPair struct {
@@ -98,7 +477,7 @@ func (p *valueCountPair) Parse(str string) error {
 	var err error
 	p.count, err = strconv.Atoi(str[indexes[4]:indexes[5]])
 	if err != nil {
-		panic(str + "\n" + err.Error())
+		return errors.New("Incorrect count of value count pair " + str + ": " + err.Error())
 	}
 	return nil
 }
@@ -106,56 +485,124 @@ func (p *valueCountPair) Parse(str string) error {
 type set struct {
 	ID     string
 	values []string
+	counts []int
 }
 
 // readSets takes a set file having the following format:
-// 1. One set per line
-// 2. Each set, all items are separated by whitespaces
-// 3. If the parameter firstItemIsID is set to true,
-//    the first itme is the unique ID of the set.
-// 4. The rest of the items with the following format:
-//    <value>____<frequency>
-//    * value is an unique element of the set
-//    * frequency is an integer count of the occurance of value
-//    * ____ (4 underscores) is the separator
-func readSets(setFilename string, firstItemIsID bool) <-chan set {
+//  1. One set per line
+//  2. Each set, all items are separated by whitespaces
+//  3. If the parameter firstItemIsID is set to true,
+//     the first itme is the unique ID of the set.
+//  4. The rest of the items with the following format:
+//     <value>____<frequency>
+//     * value is an unique element of the set
+//     * frequency is an integer count of the occurance of value
+//     * ____ (4 underscores) is the separator
+//
+// The file may be compressed with gzip or bzip2, which is detected from its
+// first bytes.
+// Unless -weighted is set, the frequencies are validated but otherwise
+// ignored: the signatures are classic MinHash of the distinct values,
+// pushing a value again, however many times, does not change its signature.
+//
+// The sets are sent on the returned channel, which is closed once the file
+// is read, and the error of reading the file, nil if none, is then sent
+// on the error channel.
+func readSets(setFilename string, firstItemIsID bool) (<-chan set, <-chan error) {
 	sets := make(chan set)
+	errc := make(chan error, 1)
 	go func() {
 		defer close(sets)
-		file, err := os.Open(setFilename)
+		errc <- sendSets(sets, setFilename, firstItemIsID)
+	}()
+	return sets, errc
+}
+
+// sendSets reads the sets of the set file and sends them to sets.
+// With -skip-bad-lines, malformed lines are reported on stderr and
+// skipped, otherwise the first one is returned as an error.
+func sendSets(sets chan<- set, setFilename string, firstItemIsID bool) error {
+	file, err := os.Open(setFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	input, err := decompress(file)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, 4096*1024*1024*8)
+	// IDs without an ID field are line numbers starting at 0,
+	// counting skipped lines.
+	var count, numSkipped int
+	for ; scanner.Scan(); count++ {
+		items := strings.Split(scanner.Text(), " ")
+		var ID string
+		if firstItemIsID {
+			ID = items[0]
+			items = items[1:]
+		} else {
+			ID = strconv.Itoa(count)
+		}
+		values, counts, err := parseItems(items)
 		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		scanner.Buffer(nil, 4096*1024*1024*8)
-		var count int
-		for scanner.Scan() {
-			items := strings.Split(scanner.Text(), " ")
-			var ID string
-			if firstItemIsID {
-				ID = items[0]
-				items = items[1:]
-			} else {
-				ID = strconv.Itoa(count)
+			err = fmt.Errorf("%s:%d: %s", setFilename, count+1, err)
+			if !skipBadLines {
+				return err
 			}
-			values := make([]string, len(items))
-			for i, item := range items {
-				var pair valueCountPair
-				if err := pair.Parse(item); err != nil {
-					fmt.Println(items)
-					panic(err)
-				}
-				values[i] = pair.value
-			}
-			sets <- set{ID, values}
-			count++
+			fmt.Fprintf(os.Stderr, "Skipping %s\n", err)
+			numSkipped++
+			continue
 		}
-		if err := scanner.Err(); err != nil {
-			panic(err)
+		sets <- set{ID, values, counts}
+	}
+	if numSkipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d malformed lines\n", numSkipped)
+	}
+	return scanner.Err()
+}
+
+// parseItems parses the <value>____<frequency> items of a set. With
+// -weighted, frequencies above minhashlsh.MaxWeight are an error, as
+// the cost of a weighted signature is proportional to them.
+func parseItems(items []string) (values []string, counts []int, err error) {
+	values = make([]string, len(items))
+	counts = make([]int, len(items))
+	for i, item := range items {
+		var pair valueCountPair
+		if err := pair.Parse(item); err != nil {
+			return nil, nil, err
 		}
-	}()
-	return sets
+		if weighted && pair.count > minhashlsh.MaxWeight {
+			return nil, nil, fmt.Errorf("Frequency of %s above the largest weight %d", item, minhashlsh.MaxWeight)
+		}
+		values[i] = pair.value
+		counts[i] = pair.count
+	}
+	return values, counts, nil
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// decompress sniffs the first bytes of the input and transparently
+// decompresses gzip and bzip2 input; any other input is read as is.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
 }
 
 type setSig struct {
@@ -165,28 +612,149 @@ type setSig struct {
 }
 
 func createSigantures(sets <-chan set) <-chan setSig {
+	if minSetSize > 0 {
+		return skipSmallSets(createAllSigantures(sets))
+	}
+	return createAllSigantures(sets)
+}
+
+func createAllSigantures(sets <-chan set) <-chan setSig {
+	if mergeByID {
+		return mergeSiganturesByID(sets)
+	}
 	out := make(chan setSig)
 	go func() {
 		defer close(out)
 		for set := range sets {
-			mh := minhashlsh.NewMinhash(minhashSeed, minhashSize)
-			for _, v := range set.values {
-				mh.Push([]byte(v))
+			out <- setSig{set.ID, len(set.values), setMinhash(set).Signature()}
+		}
+	}()
+	return out
+}
+
+// skipSmallSets leaves out the sets with fewer than -minsize values,
+// and reports the number of sets skipped on stderr.
+func skipSmallSets(sigs <-chan setSig) <-chan setSig {
+	out := make(chan setSig)
+	go func() {
+		defer close(out)
+		var numSkipped int
+		for s := range sigs {
+			if s.size < minSetSize {
+				numSkipped++
+				continue
 			}
-			out <- setSig{set.ID, len(set.values), mh.Signature()}
+			out <- s
 		}
+		fmt.Fprintf(os.Stderr, "Skipped %d sets with fewer than %d values\n", numSkipped, minSetSize)
 	}()
 	return out
 }
 
+// mergeSiganturesByID merges the Minhash of all the sets with the same ID
+// into the Minhash of their union, using the same hash function seeds
+// for all sets. The signatures are sent after all sets are read, in the
+// order their IDs first appear, and the size is the total of the sizes
+// of the merged sets.
+func mergeSiganturesByID(sets <-chan set) <-chan setSig {
+	out := make(chan setSig)
+	go func() {
+		defer close(out)
+		var IDs []string
+		minhashes := make(map[string]*minhashlsh.Minhash)
+		sizes := make(map[string]int)
+		for set := range sets {
+			mh := setMinhash(set)
+			if merged, exist := minhashes[set.ID]; exist {
+				merged.Merge(mh)
+			} else {
+				minhashes[set.ID] = mh
+				IDs = append(IDs, set.ID)
+			}
+			sizes[set.ID] += len(set.values)
+		}
+		for _, ID := range IDs {
+			out <- setSig{ID, sizes[ID], minhashes[ID].Signature()}
+		}
+	}()
+	return out
+}
+
+// setMinhash creates the Minhash of the values or shingles of a set,
+// or with -weighted, the weighted Minhash of the values and their counts.
+func setMinhash(set set) *minhashlsh.Minhash {
+	mh := minhashlsh.NewMinhashWithHasherSeeds(hasherSeed1, hasherSeed2, minhashSize)
+	if weighted {
+		// The weights are checked by parseItems.
+		for i, v := range set.values {
+			mh.PushWeighted([]byte(v), set.counts[i])
+		}
+		return mh
+	}
+	for _, v := range shingles(set.values, shingleSize) {
+		mh.Push([]byte(v))
+	}
+	return mh
+}
+
+// shingles returns the n-grams of n consecutive values joined by a
+// space, which cannot appear in values. With n of 1 or less the values
+// are returned as is. Fewer than n values form a single shingle.
+func shingles(values []string, n int) []string {
+	if n <= 1 {
+		return values
+	}
+	if len(values) <= n {
+		return []string{strings.Join(values, " ")}
+	}
+	result := make([]string, len(values)-n+1)
+	for i := range result {
+		result[i] = strings.Join(values[i:i+n], " ")
+	}
+	return result
+}
+
+// The number of pairs sent at once by the workers of allPairs, and the
+// size of the buffer of the output.
+const (
+	pairBatchSize    = 1024
+	outputBufferSize = 64 * 1024
+)
+
 type pair struct {
 	ID1 string
 	ID2 string
 }
 
-func (p *pair) String() string {
-	if p.ID1 <= p.ID2 {
-		return fmt.Sprintf("%s, %s", p.ID1, p.ID2)
+// normalized returns the pair with the smaller ID first, as written.
+func (p pair) normalized() pair {
+	if p.ID1 > p.ID2 {
+		return pair{p.ID2, p.ID1}
+	}
+	return p
+}
+
+// pairOrder sorts normalized pairs by their first then second ID.
+type pairOrder []pair
+
+func (s pairOrder) Len() int      { return len(s) }
+func (s pairOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s pairOrder) Less(i, j int) bool {
+	if s[i].ID1 != s[j].ID1 {
+		return s[i].ID1 < s[j].ID1
+	}
+	return s[i].ID2 < s[j].ID2
+}
+
+// writeTo writes the line of the pair, its IDs in order separated by a
+// comma, without formatting it first.
+func (p *pair) writeTo(w *bufio.Writer) {
+	ID1, ID2 := p.ID1, p.ID2
+	if ID1 > ID2 {
+		ID1, ID2 = ID2, ID1
 	}
-	return fmt.Sprintf("%s, %s", p.ID2, p.ID1)
+	w.WriteString(ID1)
+	w.WriteString(", ")
+	w.WriteString(ID2)
+	w.WriteByte('\n')
 }
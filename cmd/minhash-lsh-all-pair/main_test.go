@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	minhashlsh "github.com/ekzhu/minhash-lsh"
+)
+
+var update = flag.Bool("update", false, "Update the golden files")
+
+// setFlags sets the flags to their defaults for the test set file.
+func setFlags() {
+	setFilename = filepath.Join("testdata", "sets.txt")
+	minhashSeed = 42
+	hasherSeed1, hasherSeed2 = minhashlsh.HasherSeeds(minhashSeed)
+	minhashSize = 128
+	threshold = 0.9
+	outputSelfPair = false
+	hasID = true
+	numWorkers = 1
+	shingleSize = 1
+	mergeByID = false
+	minSetSize = 0
+	weighted = false
+	estimate = 0
+	indexFilename = ""
+	skipBadLines = false
+	sortOutput = false
+	dedupWindow = 1000000
+}
+
+// checkGolden compares the output with the golden file, or updates the
+// golden file with -update. If unordered is set, the lines of the output
+// are sorted first, as the order of the pairs is not deterministic.
+func checkGolden(t *testing.T, name string, output []byte, unordered bool) {
+	if unordered {
+		lines := strings.SplitAfter(string(output), "\n")
+		sort.Strings(lines)
+		output = []byte(strings.Join(lines, ""))
+	}
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("output differs from %s:\n%s", golden, output)
+	}
+}
+
+func TestAllPairs(t *testing.T) {
+	setFlags()
+	var out bytes.Buffer
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "allpair", out.Bytes(), true)
+}
+
+func TestAllPairsSelfPair(t *testing.T) {
+	setFlags()
+	outputSelfPair = true
+	var out bytes.Buffer
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "allpair_selfpair", out.Bytes(), true)
+}
+
+func TestAllPairsNoWorkers(t *testing.T) {
+	setFlags()
+	numWorkers = -1
+	var out bytes.Buffer
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "allpair", out.Bytes(), true)
+}
+
+func TestAllPairsSorted(t *testing.T) {
+	setFlags()
+	sortOutput = true
+	numWorkers = 4
+	var out bytes.Buffer
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	var pairs pairOrder
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		IDs := strings.Split(line, ", ")
+		pairs = append(pairs, pair{IDs[0], IDs[1]})
+	}
+	if !sort.IsSorted(pairs) {
+		t.Fatalf("expected sorted pairs, got %s", out.String())
+	}
+	checkGolden(t, "allpair", out.Bytes(), true)
+}
+
+func TestStreamDedup(t *testing.T) {
+	setFlags()
+	var out bytes.Buffer
+	if err := streamDedup(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "dedup", out.Bytes(), false)
+}
+
+func TestStreamDedupWindow(t *testing.T) {
+	setFlags()
+	// doc2 is compared with doc1 before it, but doc5 only with doc4, not
+	// with doc3 two sets before it.
+	dedupWindow = 1
+	var out bytes.Buffer
+	if err := streamDedup(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if lines[1] != "doc2, duplicate, doc1" || lines[4] != "doc5, unique" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	// A window above the batch size.
+	dedupWindow = 2 * dedupBatchSize
+	out.Reset()
+	if err := streamDedup(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "dedup", out.Bytes(), false)
+}
+
+func TestAllPairsGzip(t *testing.T) {
+	setFlags()
+	data, err := ioutil.ReadFile(setFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "minhash-lsh-all-pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	setFilename = filepath.Join(dir, "sets.txt.gz")
+	if err := ioutil.WriteFile(setFilename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	// Compressed input must give the same pairs as the plain file.
+	checkGolden(t, "allpair", out.Bytes(), true)
+}
+
+func TestEstimatePairs(t *testing.T) {
+	setFlags()
+	var pairs bytes.Buffer
+	if err := allPairs(&pairs); err != nil {
+		t.Fatal(err)
+	}
+	numPairs := strings.Count(pairs.String(), "\n")
+
+	// Sampling every set gives the exact number of pairs.
+	estimate = 1
+	var out bytes.Buffer
+	if err := estimatePairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("Estimated %d pairs from ", numPairs)
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestWeightTooLarge(t *testing.T) {
+	setFlags()
+	items := []string{"a____1", "x____9000000000"}
+	if _, _, err := parseItems(items); err != nil {
+		t.Fatal(err)
+	}
+	weighted = true
+	if _, _, err := parseItems(items); err == nil {
+		t.Fatal("expected error for a weight above the largest weight")
+	}
+}
+
+func TestBadLines(t *testing.T) {
+	setFlags()
+	data, err := ioutil.ReadFile(setFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "minhash-lsh-all-pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setFilename = filepath.Join(dir, "sets.txt")
+	data = append([]byte("bad w00____x\n"), data...)
+	if err := ioutil.WriteFile(setFilename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = allPairs(&out)
+	if err == nil || !strings.Contains(err.Error(), "sets.txt:1:") {
+		t.Fatalf("expected an error for line 1, got %v", err)
+	}
+
+	skipBadLines = true
+	out.Reset()
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "allpair", out.Bytes(), true)
+
+	setFilename = filepath.Join(dir, "missing.txt")
+	if err := allPairs(&out); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestSeedFile(t *testing.T) {
+	setFlags()
+	dir, err := ioutil.TempDir("", "minhash-lsh-all-pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedFilename := filepath.Join(dir, "seeds")
+
+	// The first run writes the seeds derived from -seed.
+	if err := loadOrSaveHasherSeeds(seedFilename); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "allpair", out.Bytes(), true)
+
+	// The second run reads them, whatever the -seed.
+	seed1, seed2 := hasherSeed1, hasherSeed2
+	minhashSeed = 7
+	hasherSeed1, hasherSeed2 = minhashlsh.HasherSeeds(minhashSeed)
+	if err := loadOrSaveHasherSeeds(seedFilename); err != nil {
+		t.Fatal(err)
+	}
+	if hasherSeed1 != seed1 || hasherSeed2 != seed2 {
+		t.Fatalf("expected the seeds %d %d of the seed file, got %d %d", seed1, seed2, hasherSeed1, hasherSeed2)
+	}
+	out.Reset()
+	if err := allPairs(&out); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "allpair", out.Bytes(), true)
+}
+
+func TestSeedFileCorrupt(t *testing.T) {
+	setFlags()
+	dir, err := ioutil.TempDir("", "minhash-lsh-all-pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedFilename := filepath.Join(dir, "seeds")
+	if err := ioutil.WriteFile(seedFilename, []byte("1 nope\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = loadOrSaveHasherSeeds(seedFilename)
+	if err == nil || !strings.Contains(err.Error(), "Incorrect seed file") {
+		t.Fatalf("expected an error for a corrupt seed file, got %v", err)
+	}
+}
+
+func TestShingles(t *testing.T) {
+	values := []string{"a", "b", "c", "d"}
+	cases := []struct {
+		values   []string
+		n        int
+		expected []string
+	}{
+		{values, 0, values},
+		{values, 1, values},
+		{values, 2, []string{"a b", "b c", "c d"}},
+		{values, 3, []string{"a b c", "b c d"}},
+		{values, 4, []string{"a b c d"}},
+		{values, 5, []string{"a b c d"}},
+		{values[:1], 2, []string{"a"}},
+		{nil, 2, []string{""}},
+	}
+	for _, c := range cases {
+		if result := shingles(c.values, c.n); !reflect.DeepEqual(result, c.expected) {
+			t.Errorf("shingles(%q, %d) = %q, expected %q", c.values, c.n, result, c.expected)
+		}
+	}
+}
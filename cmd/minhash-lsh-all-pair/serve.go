@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	minhashlsh "github.com/ekzhu/minhash-lsh"
+)
+
+// serve builds the index of the sets, or loads it from -index, and
+// answers queries on addr until the process is killed.
+func serve(addr string) error {
+	start := time.Now()
+	lsh, err := loadOrBuildIndex()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Indexing time: %.2f seconds\n", time.Now().Sub(start).Seconds())
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Fprintf(os.Stderr, "Serving queries on %s\n", listener.Addr())
+	return serveQueries(listener, lsh)
+}
+
+// loadOrBuildIndex loads the index from -index if the file exists,
+// otherwise it indexes the sets of -input, and saves the index to
+// -index if given. A loaded index must have been built with the same
+// -seed, -sigsize and -threshold as the queries, it is an error if the
+// -sigsize or -threshold differ, the -seed cannot be checked.
+func loadOrBuildIndex() (*minhashlsh.MinhashLSH, error) {
+	if indexFilename != "" {
+		file, err := os.Open(indexFilename)
+		if err == nil {
+			defer file.Close()
+			lsh, err := minhashlsh.Load(bufio.NewReader(file), nil)
+			if err != nil {
+				return nil, err
+			}
+			if p := lsh.ExplainParams(); p.NumHash != minhashSize || p.Threshold != threshold {
+				return nil, fmt.Errorf("The index %s was built with -sigsize %d and -threshold %g, not %d and %g",
+					indexFilename, p.NumHash, p.Threshold, minhashSize, threshold)
+			}
+			return lsh, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	lsh := minhashlsh.NewMinhashLSH(minhashSize, threshold, 0)
+	sets, errc := readSets(setFilename, hasID)
+	for s := range createSigantures(sets) {
+		lsh.Add(s.ID, s.signature)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	lsh.Index()
+	if indexFilename != "" {
+		file, err := os.Create(indexFilename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		w := bufio.NewWriter(file)
+		if err := lsh.Save(w, nil); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return lsh, nil
+}
+
+// serveQueries accepts connections on the listener and answers the
+// queries of each connection concurrently, until the listener is closed.
+func serveQueries(listener net.Listener, lsh *minhashlsh.MinhashLSH) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			answerQueries(conn, conn, lsh)
+		}()
+	}
+}
+
+// The longest set query line, a signature query can be longer with a
+// large -sigsize.
+const maxSetQuerySize = 1024 * 1024
+
+// maxQuerySize returns the longest query line read, so a client cannot
+// make the server buffer a line of any length.
+func maxQuerySize() int {
+	if n := len("sig ") + 16*minhashSize; n > maxSetQuerySize {
+		return n
+	}
+	return maxSetQuerySize
+}
+
+// answerQueries reads one query per line and writes one line per query.
+// A query is either a set in the format of the set file, without an ID,
+// or the word sig followed by a signature encoded by SigToHex. The answer
+// is the sorted IDs of the candidates separated by spaces, or a line
+// starting with "error: " if the query is incorrect. A line longer than
+// maxQuerySize is answered by an error, and ends the queries.
+func answerQueries(r io.Reader, w io.Writer, lsh *minhashlsh.MinhashLSH) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxQuerySize())
+	bw := bufio.NewWriter(w)
+	for scanner.Scan() {
+		candidates, err := pointquery(lsh, scanner.Text())
+		if err != nil {
+			bw.WriteString("error: " + err.Error() + "\n")
+		} else {
+			bw.WriteString(strings.Join(candidates, " ") + "\n")
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	if scanner.Err() == bufio.ErrTooLong {
+		fmt.Fprintf(w, "error: The query is longer than %d bytes\n", maxQuerySize())
+	}
+	return scanner.Err()
+}
+
+// pointquery returns the sorted IDs of the candidates of a single query.
+func pointquery(lsh *minhashlsh.MinhashLSH, query string) ([]string, error) {
+	var sig []uint64
+	if strings.HasPrefix(query, "sig ") {
+		var err error
+		if sig, err = minhashlsh.HexToSig(strings.TrimPrefix(query, "sig ")); err != nil {
+			return nil, err
+		}
+		if len(sig) != minhashSize {
+			return nil, fmt.Errorf("Expected a signature of %d hash values, got %d", minhashSize, len(sig))
+		}
+	} else {
+		values, counts, err := parseItems(strings.Split(query, " "))
+		if err != nil {
+			return nil, err
+		}
+		sig = setMinhash(set{values: values, counts: counts}).Signature()
+	}
+	candidates := lsh.Query(sig)
+	IDs := make([]string, len(candidates))
+	for i, candidateID := range candidates {
+		IDs[i] = candidateID.(string)
+	}
+	sort.Strings(IDs)
+	return IDs, nil
+}
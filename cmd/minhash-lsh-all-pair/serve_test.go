@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	minhashlsh "github.com/ekzhu/minhash-lsh"
+)
+
+func TestAnswerQueries(t *testing.T) {
+	setFlags()
+	lsh, err := loadOrBuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc3 := setMinhash(set{values: []string{
+		"w20", "w21", "w22", "w23", "w24", "w25", "w26", "w27", "w28", "w29",
+		"w30", "w31", "w32", "w33", "w34", "w35", "w36", "w37", "w38", "w39",
+	}}).Signature()
+	queries := strings.Join([]string{
+		"w00____1 w01____1 w02____1 w03____1 w04____1 w05____1 w06____1 w07____1 w08____1 w09____1 " +
+			"w10____1 w11____1 w12____1 w13____1 w14____1 w15____1 w16____1 w17____1 w18____1 w19____1",
+		"sig " + minhashlsh.SigToHex(doc3),
+		"z00____1",
+		"w00",
+		"sig 00",
+	}, "\n")
+	var out bytes.Buffer
+	if err := answerQueries(strings.NewReader(queries), &out, lsh); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	expected := []string{"doc1 doc2", "doc3 doc5", ""}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Errorf("expected %q for query %d, got %q", line, i, lines[i])
+		}
+	}
+	for _, line := range lines[3:5] {
+		if !strings.HasPrefix(line, "error: ") {
+			t.Errorf("expected an error, got %q", line)
+		}
+	}
+
+	out.Reset()
+	long := strings.Repeat("w00____1 ", maxQuerySize()/9+1)
+	if err := answerQueries(strings.NewReader(long+"\nw00____1\n"), &out, lsh); err == nil {
+		t.Fatal("expected error for a too long query")
+	}
+	if !strings.HasPrefix(out.String(), "error: ") {
+		t.Fatalf("expected an error, got %q", out.String())
+	}
+}
+
+func TestServeQueries(t *testing.T) {
+	setFlags()
+	dir, err := ioutil.TempDir("", "minhash-lsh-all-pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	indexFilename = filepath.Join(dir, "index")
+	// The first call builds and saves the index, the second loads it.
+	if _, err := loadOrBuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	setFilename = ""
+	lsh, err := loadOrBuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	minhashSize = 64
+	if _, err := loadOrBuildIndex(); err == nil {
+		t.Fatal("expected error for an index of a different -sigsize")
+	}
+	minhashSize = 128
+	threshold = 0.8
+	if _, err := loadOrBuildIndex(); err == nil {
+		t.Fatal("expected error for an index of a different -threshold")
+	}
+	threshold = 0.9
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serveQueries(listener, lsh)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("w00____1 w01____1 w02____1 w03____1 w04____1 w05____1 w06____1 w07____1 w08____1 w09____1 " +
+		"w10____1 w11____1 w12____1 w13____1 w14____1 w15____1 w16____1 w17____1 w18____1 w19____1\n"))
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "doc1 doc2\n" {
+		t.Fatalf("expected doc1 and doc2, got %q", answer)
+	}
+}
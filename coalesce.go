@@ -0,0 +1,197 @@
+package minhashlsh
+
+import (
+	"sort"
+	"strings"
+)
+
+// CoalesceIdenticalSignatures makes the index store keys with identical
+// signatures once: the first key added with a signature is indexed, and
+// the keys added later with the same signature become its aliases, which
+// take no space in the hash tables. Every query returning candidates,
+// except BucketMates, QueryByBand and SamplePairs which only see the
+// indexed keys, returns the aliases of a candidate together with it, with
+// the same band matches. Signatures are identical when their hash keys
+// are, i.e. the hash values used by the bands, truncated to the hash value
+// size of the index, are equal. Removing an alias leaves its key indexed,
+// and removing an indexed key with aliases makes its first alias the
+// indexed key. This saves memory for corpora with many exact duplicates.
+// With it, calls to Add are serialized, and BuildSorted is implemented by
+// Add and Index.
+func CoalesceIdenticalSignatures() Option {
+	return func(f *MinhashLSH) {
+		f.coalesce = true
+		f.sigOwners = make(map[string]interface{})
+		f.aliases = make(map[interface{}][]interface{})
+		f.aliasOf = make(map[interface{}]interface{})
+	}
+}
+
+// contains returns true if the key is in the index, indexed or as an
+// alias, the caller must hold keysLock.
+func (f *MinhashLSH) contains(key interface{}) bool {
+	if _, exist := f.members[key]; exist {
+		return true
+	}
+	_, exist := f.aliasOf[key]
+	return exist
+}
+
+// addAlias adds the key as an alias of the key indexed with the same
+// hash keys, if there is one and the key is not indexed itself, and
+// returns true if it did. The caller must hold keysLock.
+func (f *MinhashLSH) addAlias(key interface{}, hashKeys []string, sig []uint64) bool {
+	owner, exist := f.sigOwners[strings.Join(hashKeys, "")]
+	if !exist || owner == key {
+		return false
+	}
+	if _, member := f.members[key]; member {
+		return false
+	}
+	f.aliasOf[key] = owner
+	f.aliases[owner] = append(f.aliases[owner], key)
+	if f.signatures != nil {
+		f.signatures[key] = append([]uint64(nil), sig...)
+	}
+	return true
+}
+
+// removeAlias removes an alias and everything recorded about it,
+// the caller must hold keysLock.
+func (f *MinhashLSH) removeAlias(alias interface{}) {
+	owner := f.aliasOf[alias]
+	aliases := f.aliases[owner]
+	for i := range aliases {
+		if aliases[i] == alias {
+			aliases = append(aliases[:i], aliases[i+1:]...)
+			break
+		}
+	}
+	if len(aliases) == 0 {
+		delete(f.aliases, owner)
+	} else {
+		f.aliases[owner] = aliases
+	}
+	delete(f.aliasOf, alias)
+	delete(f.signatures, alias)
+	delete(f.values, alias)
+	delete(f.sizes, alias)
+	delete(f.elements, alias)
+}
+
+// promoteAlias removes an indexed key having aliases by making its first
+// alias the indexed key in its place, the caller must hold keysLock.
+func (f *MinhashLSH) promoteAlias(key interface{}) {
+	aliases := f.aliases[key]
+	promoted := aliases[0]
+	hashKeys := f.members[key]
+	f.renameEntries(key, promoted, hashKeys)
+	f.members[promoted] = hashKeys
+	delete(f.members, key)
+	for i := 0; i+f.l <= len(hashKeys); i += f.l {
+		sigKey := strings.Join(hashKeys[i:i+f.l], "")
+		if f.sigOwners[sigKey] == key {
+			f.sigOwners[sigKey] = promoted
+		}
+	}
+	delete(f.aliases, key)
+	delete(f.aliasOf, promoted)
+	if len(aliases) > 1 {
+		f.aliases[promoted] = aliases[1:]
+		for _, alias := range aliases[1:] {
+			f.aliasOf[alias] = promoted
+		}
+	}
+	delete(f.signatures, key)
+	delete(f.values, key)
+	delete(f.sizes, key)
+	delete(f.elements, key)
+	if f.lru != nil {
+		if e, exist := f.lruElements[key]; exist {
+			f.lru.Remove(e)
+			delete(f.lruElements, key)
+		}
+		f.touch(promoted)
+	}
+}
+
+// releaseSignatures forgets the signatures owned by a key about to be
+// removed, the caller must hold keysLock.
+func (f *MinhashLSH) releaseSignatures(key interface{}) {
+	hashKeys := f.members[key]
+	for i := 0; i+f.l <= len(hashKeys); i += f.l {
+		sigKey := strings.Join(hashKeys[i:i+f.l], "")
+		if f.sigOwners[sigKey] == key {
+			delete(f.sigOwners, sigKey)
+		}
+	}
+}
+
+// rebuildSigOwners records the indexed keys as the owners of their hash
+// keys, e.g. after the hash keys changed, keeping a single owner of the
+// hash keys shared by indexed keys. The caller must hold keysLock.
+func (f *MinhashLSH) rebuildSigOwners() {
+	f.sigOwners = make(map[string]interface{}, len(f.members))
+	for key, hashKeys := range f.members {
+		for i := 0; i+f.l <= len(hashKeys); i += f.l {
+			sigKey := strings.Join(hashKeys[i:i+f.l], "")
+			if _, exist := f.sigOwners[sigKey]; !exist {
+				f.sigOwners[sigKey] = key
+			}
+		}
+	}
+}
+
+// renameEntries replaces the key of all the entries of key in the hash
+// tables by newKey, hashKeys are the hash keys of the key as recorded in
+// members. The order of the entries is unchanged.
+func (f *MinhashLSH) renameEntries(key, newKey interface{}, hashKeys []string) {
+	for i := range f.hashTables {
+		f.locks[i].Lock()
+		table := f.hashTables[i]
+		for j := i; j < len(hashKeys); j += f.l {
+			hashKey := hashKeys[j]
+			// Look up the indexed part using binary search first.
+			x := sort.Search(f.numIndexedKeys, func(x int) bool {
+				return table[x].hashKey >= hashKey
+			})
+			for ; x < f.numIndexedKeys && table[x].hashKey == hashKey; x++ {
+				if table[x].key == key {
+					break
+				}
+			}
+			if x == f.numIndexedKeys || table[x].hashKey != hashKey {
+				for x = f.numIndexedKeys; x < len(table); x++ {
+					if table[x].hashKey == hashKey && table[x].key == key {
+						break
+					}
+				}
+			}
+			if x < len(table) {
+				table[x].key = newKey
+			}
+		}
+		f.locks[i].Unlock()
+	}
+}
+
+// addAliases adds the aliases of the candidates to the candidates, with
+// the band matches of their keys, leaving out the aliases for which skip
+// returns true and stopping once limit candidates are found.
+func (f *MinhashLSH) addAliases(results map[interface{}]int, skip func(interface{}) bool, limit int) {
+	candidates := make([]interface{}, 0, len(results))
+	for key := range results {
+		candidates = append(candidates, key)
+	}
+	for _, key := range candidates {
+		for _, alias := range f.aliases[key] {
+			if limit > 0 && len(results) >= limit {
+				return
+			}
+			if skip != nil && skip(alias) {
+				continue
+			}
+			results[alias] = results[key]
+		}
+	}
+}
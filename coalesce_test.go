@@ -0,0 +1,132 @@
+package minhashlsh
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_MinhashLSHCoalesceIdenticalSignatures(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 4, CoalesceIdenticalSignatures(), StoreSignatures())
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	f.Add("sig2", sig)
+	f.Add("sig3", sig)
+	f.Add("sig4", randomSignature(256, 2))
+	f.Index()
+
+	for _, table := range f.hashTables {
+		if len(table) != 2 {
+			t.Fatal("expected aliases to take no space in the hash tables")
+		}
+	}
+	if results := f.Query(sig); len(results) != 3 {
+		t.Fatal(results)
+	}
+	if results := f.QueryExcluding(sig, "sig2"); len(results) != 2 {
+		t.Fatal(results)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := f.Save(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig); len(results) != 3 {
+		t.Fatal(results)
+	}
+
+	// Removing the indexed key makes an alias the indexed key.
+	if !f.Remove("sig1") {
+		t.Fatal("expected sig1 to be removed")
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	results := f.Query(sig)
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	for _, key := range results {
+		if key != "sig2" && key != "sig3" {
+			t.Fatal(results)
+		}
+	}
+	if !f.Remove("sig3") {
+		t.Fatal("expected alias sig3 to be removed")
+	}
+	if results := f.Query(sig); len(results) != 1 {
+		t.Fatal(results)
+	}
+	f.Remove("sig2")
+	if results := f.Query(sig); len(results) != 0 {
+		t.Fatal(results)
+	}
+	// The signature is no longer owned by a removed key.
+	f.Add("sig5", sig)
+	f.Index()
+	if results := f.Query(sig); len(results) != 1 || results[0] != "sig5" {
+		t.Fatal(results)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_MinhashLSHCoalesceBuildSorted(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 4, CoalesceIdenticalSignatures())
+	sig := randomSignature(256, 1)
+	if err := f.BuildSorted([]interface{}{1, 2}, [][]uint64{sig, sig}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.hashTables[0]) != 1 {
+		t.Fatal("expected one indexed key")
+	}
+	if results := f.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHCoalesceRehashKeyWidth(t *testing.T) {
+	f := NewMinhashLSH64(256, 0.6, 4, CoalesceIdenticalSignatures(), StoreSignatures())
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	f.Add("sig2", randomSignature(256, 2))
+	f.Index()
+	if err := f.RehashKeyWidth(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Identical signatures are still coalesced with the new hash keys.
+	f.Add("sig1b", sig)
+	if len(f.aliasOf) != 1 || len(f.members) != 2 {
+		t.Fatalf("expected an alias, got %d aliases and %d keys", len(f.aliasOf), len(f.members))
+	}
+	if err := f.RehashKeyWidth(8); err == nil {
+		t.Fatal("expected error for widening the hash keys of aliases")
+	}
+	f.Remove("sig2")
+	f.Remove("sig1")
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if results := f.Query(sig); len(results) != 1 || results[0] != "sig1b" {
+		t.Fatal(results)
+	}
+
+	// A coalesced signature no longer held by its key.
+	f.sigOwners["stale"] = "sig1b"
+	if err := f.Validate(); err == nil {
+		t.Fatal("expected error for a stale coalesced signature")
+	}
+}
@@ -0,0 +1,94 @@
+package minhashlsh
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// ParamsExplanation describes how the parameters of an index drive its
+// accuracy and memory usage, as reported by ExplainParams.
+type ParamsExplanation struct {
+	// NumHash is the number of hash functions of the signatures.
+	NumHash int
+	// Threshold is the Jaccard similarity threshold of the index.
+	Threshold float64
+	// Bands is the number of bands L, every band is a hash table with an
+	// entry per key, so memory grows linearly with it, and so does recall.
+	Bands int
+	// RowsPerBand is the number of hash values per band K, more rows make
+	// collisions in a band less likely, which lowers false positives at
+	// the cost of recall.
+	RowsPerBand int
+	// RecallAtThreshold is the probability that a key whose similarity
+	// with the query is exactly the threshold is a candidate.
+	RecallAtThreshold float64
+	// FalsePositiveWeight and FalseNegativeWeight are the probabilities of
+	// false positives and false negatives integrated over the similarities
+	// below and above the threshold, whose sum K and L are chosen to
+	// minimize.
+	FalsePositiveWeight float64
+	FalseNegativeWeight float64
+	// NumKeys is the number of keys the memory is estimated for.
+	NumKeys int
+	// MemoryPerBand is the estimated memory of a band in bytes.
+	MemoryPerBand int64
+	// Memory is the estimated memory of the index in bytes, including the
+	// bands, the hash keys of every key and the stored signatures, but not
+	// the keys themselves.
+	Memory int64
+}
+
+// String formats the explanation for humans.
+func (e ParamsExplanation) String() string {
+	return fmt.Sprintf("%d hash functions, threshold %.2f\n"+
+		"%d bands (L) of %d rows (K)\n"+
+		"recall at threshold: %.4f\n"+
+		"false positive weight: %.4f, false negative weight: %.4f\n"+
+		"estimated memory for %d keys: %d bytes, %d bytes per band\n",
+		e.NumHash, e.Threshold, e.Bands, e.RowsPerBand, e.RecallAtThreshold,
+		e.FalsePositiveWeight, e.FalseNegativeWeight,
+		e.NumKeys, e.Memory, e.MemoryPerBand)
+}
+
+// ExplainParams reports the number of bands, rows per band, theoretical
+// accuracy and estimated memory of the index for the keys it holds.
+func (f *MinhashLSH) ExplainParams() ParamsExplanation {
+	f.keysLock.Lock()
+	numKeys := len(f.members)
+	f.keysLock.Unlock()
+	return f.ExplainParamsFor(numKeys)
+}
+
+// ExplainParamsFor is like ExplainParams, but estimates the memory for
+// numKeys keys, e.g. to plan the memory of an index before adding keys.
+// The estimate assumes every key is added once.
+func (f *MinhashLSH) ExplainParamsFor(numKeys int) ParamsExplanation {
+	e := ParamsExplanation{
+		NumHash:             f.numHash,
+		Threshold:           f.threshold,
+		Bands:               f.l,
+		RowsPerBand:         f.k,
+		RecallAtThreshold:   f.ExpectedRecallAtThreshold(),
+		FalsePositiveWeight: probFalsePositive(f.l, f.k, f.threshold, integrationPrecision),
+		FalseNegativeWeight: probFalseNegative(f.l, f.k, f.threshold, integrationPrecision),
+		NumKeys:             numKeys,
+	}
+	// Every entry holds a hash key and the key.
+	hashKeySize := roundUp(int64(f.hashKeySize()), 8)
+	e.MemoryPerBand = int64(numKeys) * (int64(unsafe.Sizeof(entry{})) + hashKeySize)
+	// The members of a key refer to the hash keys of the bands.
+	memberSize := int64(f.l)*int64(unsafe.Sizeof("")) + mapEntrySize
+	e.Memory = int64(f.l)*e.MemoryPerBand + int64(numKeys)*memberSize
+	if f.signatures != nil {
+		e.Memory += int64(numKeys) * (int64(f.numHash)*8 + mapEntrySize)
+	}
+	return e
+}
+
+// mapEntrySize is a rough size in bytes of an entry of a map from
+// interface{} keys to slices, including the overhead of the map.
+const mapEntrySize = 64
+
+func roundUp(n, m int64) int64 {
+	return (n + m - 1) / m * m
+}
@@ -0,0 +1,35 @@
+package minhashlsh
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_MinhashLSHExplainParams(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 10)
+	for i := 0; i < 10; i++ {
+		f.Add(i, randomSignature(256, int64(i)))
+	}
+	f.Index()
+	e := f.ExplainParams()
+	k, l := f.Params()
+	if e.Bands != l || e.RowsPerBand != k || e.NumKeys != 10 {
+		t.Fatal(e)
+	}
+	if e.RecallAtThreshold != f.ExpectedRecallAtThreshold() {
+		t.Fatal(e.RecallAtThreshold)
+	}
+	if e.MemoryPerBand <= 0 || e.Memory < int64(l)*e.MemoryPerBand {
+		t.Fatal(e)
+	}
+	if twice := f.ExplainParamsFor(20); twice.MemoryPerBand != 2*e.MemoryPerBand {
+		t.Fatal("expected memory linear in the number of keys")
+	}
+	withSignatures := NewMinhashLSH16(256, 0.6, 0, StoreSignatures()).ExplainParamsFor(10)
+	if withSignatures.Memory <= e.Memory {
+		t.Fatal("expected stored signatures to take memory")
+	}
+	if !strings.Contains(e.String(), "bands (L)") {
+		t.Fatal(e.String())
+	}
+}
@@ -1,9 +1,16 @@
 package minhashlsh
 
 import (
-	"encoding/binary"
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
 	"math"
+	"math/rand"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
 )
 
 const (
@@ -15,15 +22,43 @@ type hashKeyFunc func([]uint64) string
 func hashKeyFuncGen(hashValueSize int) hashKeyFunc {
 	return func(sig []uint64) string {
 		s := make([]byte, hashValueSize*len(sig))
-		buf := make([]byte, 8)
-		for i, v := range sig {
-			binary.LittleEndian.PutUint64(buf, v)
-			copy(s[i*hashValueSize:(i+1)*hashValueSize], buf[:hashValueSize])
-		}
+		putSigValues(s, sig, hashValueSize)
 		return string(s)
 	}
 }
 
+// The FNV-1a parameters of hashedKeyFuncGen.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// hashedKeyFuncGen returns a hashKeyFunc that combines the lowest
+// hashValueSize bytes of the hash values of a band into a single 8-byte
+// hash key using FNV-1a.
+func hashedKeyFuncGen(hashValueSize int) hashKeyFunc {
+	return func(sig []uint64) string {
+		var h uint64 = fnvOffset64
+		for _, v := range sig {
+			for j := 0; j < hashValueSize; j++ {
+				h ^= (v >> (8 * uint(j))) & 0xff
+				h *= fnvPrime64
+			}
+		}
+		var b [8]byte
+		putSigValues(b[:], []uint64{h}, 8)
+		return string(b[:])
+	}
+}
+
+// mix64 is the bijective finalizer of SplitMix64, it scrambles the bits of
+// the hash values seeded by BandSeeds.
+func mix64(v uint64) uint64 {
+	v = (v ^ (v >> 30)) * 0xbf58476d1ce4e5b9
+	v = (v ^ (v >> 27)) * 0x94d049bb133111eb
+	return v ^ (v >> 31)
+}
+
 // Compute the integral of function f, lower limit a, upper limit l, and
 // precision defined as the quantize step
 func integral(f func(float64) float64, a, b, precision float64) float64 {
@@ -105,45 +140,388 @@ func (h hashTable) Less(i, j int) bool { return h[i].hashKey < h[j].hashKey }
 type MinhashLSH struct {
 	k              int
 	l              int
+	numHash        int
+	threshold      float64
 	hashTables     []hashTable
 	hashKeyFunc    hashKeyFunc
 	hashValueSize  int
 	numIndexedKeys int
+	// locks guards the hash tables, one lock per band.
+	locks []sync.Mutex
+	// members maps every added key to its hash keys, one per band,
+	// repeated for every time the key is added.
+	members map[interface{}][]string
+	// signatures is only populated when the index is created
+	// with the StoreSignatures option.
+	signatures map[interface{}][]uint64
+	// values holds the values of the keys added with AddWithValue.
+	values map[interface{}]interface{}
+	// sizes holds the set sizes of the keys added with AddWithSize.
+	sizes map[interface{}]int
+	// elements is only populated when the index is created
+	// with the RetainElements option.
+	elements map[interface{}][][]byte
+	// lru orders the keys from the most to the least recently added or
+	// queried, only for indexes created by NewMinhashLSHBounded, and
+	// lruElements maps every key to its element in lru.
+	lru         *list.List
+	lruElements map[interface{}]*list.Element
+	maxKeys     int
+	// keysLock guards members, signatures, values, sizes, elements, lru
+	// and maxBucketSize.
+	keysLock        sync.Mutex
+	skipEmpty       bool
+	autoIndex       bool
+	duplicatePolicy DuplicateKeyPolicy
+	leftover        LeftoverPolicy
+	// trackStats is set by TrackStats, then maxBucketSize is the size of
+	// the largest bucket found by the last call to Index.
+	trackStats    bool
+	maxBucketSize int
+	estimator     SimilarityEstimator
+	// hashedKeys is set when the hash keys are made by hashedKeyFuncGen.
+	hashedKeys bool
+	// bandSeeds holds the seed of every band derived from bandSeed by
+	// BandSeeds, if set.
+	bandSeed  int64
+	bandSeeds []uint64
+	// sigSeed is the seed of the signatures set by SignatureSeed, if
+	// hasSigSeed is set, and sigSeed1 and sigSeed2 the seeds of the hash
+	// functions derived from it.
+	sigSeed            int64
+	sigSeed1, sigSeed2 uint64
+	hasSigSeed         bool
+	// logger receives the warnings of the constructors set by Logger,
+	// and crowdedLogger those of Index set by WarnCrowdedBuckets.
+	logger        *log.Logger
+	crowdedLogger *log.Logger
+	// coalesce is set by CoalesceIdenticalSignatures, then sigOwners maps
+	// the band hash keys of every signature to the first key added with
+	// it, aliases maps such a key to the keys added later with the same
+	// signature, and aliasOf maps every alias to its key.
+	coalesce  bool
+	sigOwners map[string]interface{}
+	aliases   map[interface{}][]interface{}
+	aliasOf   map[interface{}]interface{}
+}
+
+// Option configures optional behaviours of MinhashLSH,
+// and is passed to the constructors.
+type Option func(*MinhashLSH)
+
+// StoreSignatures makes the index keep a copy of the signature of every
+// added key, so the results of QueryDetailed carry estimated similarities.
+// This roughly doubles the memory usage of the index.
+func StoreSignatures() Option {
+	return func(f *MinhashLSH) {
+		f.signatures = make(map[interface{}][]uint64)
+	}
+}
+
+// RetainElements makes the index keep a copy of the elements of every key
+// added with AddWithElements, so RecomputeSignatures can recompute the
+// signatures with a different seed or number of hash functions.
+// The memory cost is significant: the index holds the original sets,
+// which are usually much larger than their signatures and the index
+// itself, so it should only be used when they fit in memory.
+// Retained elements are not saved by MarshalBinary and Save.
+func RetainElements() Option {
+	return func(f *MinhashLSH) {
+		f.elements = make(map[interface{}][][]byte)
+	}
+}
+
+// Estimator sets the SimilarityEstimator computing the similarities of
+// QueryDetailed from the number of matching hash values, by default the
+// fraction of matching hash values (MatchFraction).
+func Estimator(e SimilarityEstimator) Option {
+	return func(f *MinhashLSH) {
+		f.estimator = e
+	}
+}
+
+// WarnCrowdedBuckets makes Index log a warning to logger when more than
+// half of the entries of a band share one bucket, which is rarely the
+// case for real data and usually means a bug producing identical
+// signatures, e.g. pushing no values or using a different seed per key.
+// The check only scans the first band, so it is cheap, and is off by
+// default.
+func WarnCrowdedBuckets(logger *log.Logger) Option {
+	return func(f *MinhashLSH) {
+		f.crowdedLogger = logger
+	}
+}
+
+// Logger makes the constructors log a warning to logger when no k and l
+// are found for their parameters and they fall back to k = 1, l = 1,
+// e.g. for fewer than one hash function. Without it nothing is logged.
+func Logger(logger *log.Logger) Option {
+	return func(f *MinhashLSH) {
+		f.logger = logger
+	}
+}
+
+// The minimum number of entries of a band for WarnCrowdedBuckets to warn.
+const minCrowdedBucketSize = 10
+
+// HashedBandKeys makes the index combine the hash values of every band
+// into an 8-byte FNV-1a hash key, instead of concatenating them into a
+// hash key of k times the hash value size. For large k the shorter hash
+// keys take much less memory and make queries faster, but computing them
+// costs more, so Add and Index are no faster, and the concatenated hash
+// keys remain the default. Benchmark_BandKeys compares the two.
+// Different bands rarely have the same hashed key by chance, which only
+// adds false positive candidates. RehashKeyWidth is not supported with
+// hashed band keys.
+func HashedBandKeys() Option {
+	return func(f *MinhashLSH) {
+		f.hashedKeys = true
+		f.hashKeyFunc = hashedKeyFuncGen(f.hashValueSize)
+	}
+}
+
+// BandSeeds makes every band scramble its hash values with a different
+// seed derived from seed before they become the hash key of the band.
+// Without it, when hash keys are truncated by a hash value size below 8
+// bytes or hashed by HashedBandKeys, signatures crafted to have different
+// hash values with the same hash key in one band have them in all bands;
+// with it, such collisions are independent across bands and cannot be
+// crafted without knowing the seed. Keys whose signatures are identical in
+// a band still collide in it, so the candidates are otherwise unchanged.
+// The hash keys, and so the serialized index, depend on the seed, which
+// is saved with the index by MarshalBinary and Save and used again by the
+// loaded index; the hash tables of indexes with different seeds are not
+// comparable.
+func BandSeeds(seed int64) Option {
+	return func(f *MinhashLSH) {
+		rng := rand.New(rand.NewSource(seed))
+		f.bandSeed = seed
+		f.bandSeeds = make([]uint64, f.l)
+		for i := range f.bandSeeds {
+			f.bandSeeds[i] = uint64(rng.Int63())<<1 ^ uint64(rng.Int63())
+		}
+	}
+}
+
+// SignatureSeed records the seed of the signatures of the index, i.e. the
+// seed given to NewMinhash for them, so QuerySet can compute the query
+// signatures itself. The seed is saved with the index.
+func SignatureSeed(seed int64) Option {
+	return func(f *MinhashLSH) {
+		f.sigSeed, f.hasSigSeed = seed, true
+		f.sigSeed1, f.sigSeed2 = HasherSeeds(seed)
+	}
+}
+
+// bandKey returns the hash key of the band of the signature.
+func (f *MinhashLSH) bandKey(band int, sig []uint64) string {
+	var values []uint64
+	if band == f.l-1 && f.k*f.l > f.numHash {
+		// The last band of PadLeftoverHashValues.
+		values = make([]uint64, f.k)
+		copy(values, sig[band*f.k:f.numHash])
+	} else {
+		values = sig[band*f.k : (band+1)*f.k]
+	}
+	if f.bandSeeds != nil {
+		seeded := make([]uint64, len(values))
+		for i, v := range values {
+			seeded[i] = mix64(v ^ f.bandSeeds[band])
+		}
+		values = seeded
+	}
+	return f.hashKeyFunc(values)
+}
+
+// hashKeySize returns the length of the hash keys of the index.
+func (f *MinhashLSH) hashKeySize() int {
+	if f.hashedKeys {
+		return 8
+	}
+	return f.k * f.hashValueSize
+}
+
+// SkipEmptySignatures makes the index ignore empty signatures, i.e.
+// signatures of sets with no values, whose hash values are all the
+// maximum. Without it, all empty sets collide with each other in every
+// band. With it, Add silently drops keys with empty signatures and
+// queries with an empty signature return no candidates.
+func SkipEmptySignatures() Option {
+	return func(f *MinhashLSH) {
+		f.skipEmpty = true
+	}
+}
+
+// AutoIndex makes queries call Index first whenever keys have been added
+// since the last call to Index, so added keys are searchable without
+// calling Index explicitly. Index sorts the hash tables, so alternating
+// between Add and queries is expensive, and batch builds should still add
+// all keys before querying. With AutoIndex, queries must not be run
+// concurrently with each other or with Add.
+func AutoIndex() Option {
+	return func(f *MinhashLSH) {
+		f.autoIndex = true
+	}
+}
+
+// DuplicateKeyPolicy decides what Add does with a key that
+// is already in the index.
+type DuplicateKeyPolicy int
+
+const (
+	// AllowDuplicateKeys adds the key again, queries find it through
+	// both its previous and its new signatures. This is the default.
+	AllowDuplicateKeys DuplicateKeyPolicy = iota
+	// ReplaceDuplicateKeys removes the key from the buckets of its
+	// previous signature before adding it with the new one.
+	ReplaceDuplicateKeys
+	// RejectDuplicateKeys makes Add return ErrDuplicateKey and leave
+	// the index unchanged.
+	RejectDuplicateKeys
+)
+
+// ErrDuplicateKey is returned by Add when the key is already in the index
+// and the index is created with RejectDuplicateKeys.
+var ErrDuplicateKey = errors.New("Key already exists in the index")
+
+// DuplicateKeys sets the policy for adding keys that are already in the
+// index, by default they are allowed (AllowDuplicateKeys).
+// With the other policies, calls to Add are serialized.
+func DuplicateKeys(policy DuplicateKeyPolicy) Option {
+	return func(f *MinhashLSH) {
+		f.duplicatePolicy = policy
+	}
+}
+
+// LeftoverPolicy decides what the index does with the hash values past
+// the last band, as k*l, chosen to minimize the false positive and
+// negative weights, is often less than the number of hash functions, e.g.
+// with a threshold of 0.8, k = 13 and l = 9 for 128 hash functions,
+// leaving 11 hash values, but k = 13 and l = 10 for 130.
+type LeftoverPolicy int
+
+const (
+	// DropLeftoverHashValues leaves the hash values past the last band
+	// unused by the index. This is the default.
+	DropLeftoverHashValues LeftoverPolicy = iota
+	// PadLeftoverHashValues adds a last band of the leftover hash values,
+	// padded to k values with zeros, so every hash value is used. The
+	// extra band has fewer rows, so it adds candidates of lower
+	// similarity than the other bands, and the probabilities computed by
+	// ExpectedRecallAtThreshold, FalsePositiveRate and FalseNegativeRate
+	// treat it as a full band.
+	PadLeftoverHashValues
+	// RejectLeftoverHashValues makes the constructor panic if the number
+	// of hash functions is not k*l, e.g. to pin down a configuration.
+	RejectLeftoverHashValues
+)
+
+// LeftoverHashValues sets the policy for the hash values past the last
+// band, by default they are not used (DropLeftoverHashValues).
+func LeftoverHashValues(policy LeftoverPolicy) Option {
+	return func(f *MinhashLSH) {
+		f.leftover = policy
+	}
 }
 
-func newMinhashLSH(threshold float64, numHash, hashValueSize, initSize int) *MinhashLSH {
-	k, l, _, _ := optimalKL(numHash, threshold)
+// bandParams returns the k and l chosen for the number of hash functions
+// and the threshold, and whether they fell back to the safe minimums.
+func bandParams(numHash int, threshold float64) (k, l int, fallback bool) {
+	k, l, _, _ = optimalKL(numHash, threshold)
+	// No k and l are found for fewer than one hash function, fall back to
+	// the safe minimums instead of an index with no bands that finds nothing.
+	if k < 1 {
+		k, fallback = 1, true
+	}
+	if l < 1 {
+		l, fallback = 1, true
+	}
+	return k, l, fallback
+}
+
+func newMinhashLSH(threshold float64, numHash, hashValueSize, initSize int, opts []Option) *MinhashLSH {
+	k, l, fallback := bandParams(numHash, threshold)
 	hashTables := make([]hashTable, l)
 	for i := range hashTables {
 		hashTables[i] = make(hashTable, 0, initSize)
 	}
-	return &MinhashLSH{
+	f := &MinhashLSH{
 		k:              k,
 		l:              l,
+		numHash:        numHash,
+		threshold:      threshold,
 		hashValueSize:  hashValueSize,
 		hashTables:     hashTables,
 		hashKeyFunc:    hashKeyFuncGen(hashValueSize),
 		numIndexedKeys: 0,
+		locks:          make([]sync.Mutex, l),
+		members:        make(map[interface{}][]string, initSize),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.signatures != nil {
+		f.signatures = make(map[interface{}][]uint64, initSize)
+	}
+	if fallback && f.logger != nil {
+		f.logger.Printf("minhashlsh: no k and l for %d hash functions and threshold %g, falling back to k = 1, l = 1",
+			numHash, threshold)
 	}
+	if k*l < numHash {
+		switch f.leftover {
+		case PadLeftoverHashValues:
+			f.l++
+			f.hashTables = append(f.hashTables, make(hashTable, 0, initSize))
+			f.locks = make([]sync.Mutex, f.l)
+			if f.bandSeeds != nil {
+				BandSeeds(f.bandSeed)(f)
+			}
+		case RejectLeftoverHashValues:
+			panic(fmt.Sprintf("Number of hash functions %d is not a multiple of k = %d", numHash, k))
+		}
+	}
+	return f
 }
 
 // NewMinhashLSH64 uses 64-bit hash values and pre-allocation of hash tables.
-func NewMinhashLSH64(numHash int, threshold float64, initSize int) *MinhashLSH {
-	return newMinhashLSH(threshold, numHash, 8, initSize)
+// initSize is the expected number of keys, used to reserve capacity
+// for the hash tables and the maps keyed by keys.
+func NewMinhashLSH64(numHash int, threshold float64, initSize int, opts ...Option) *MinhashLSH {
+	return newMinhashLSH(threshold, numHash, 8, initSize, opts)
 }
 
 // NewMinhashLSH32 uses 32-bit hash values and pre-allocation of hash tables.
 // MinHash signatures with 64 bit hash values will have
 // their hash values trimed.
-func NewMinhashLSH32(numHash int, threshold float64, initSize int) *MinhashLSH {
-	return newMinhashLSH(threshold, numHash, 4, initSize)
+func NewMinhashLSH32(numHash int, threshold float64, initSize int, opts ...Option) *MinhashLSH {
+	return newMinhashLSH(threshold, numHash, 4, initSize, opts)
 }
 
 // NewMinhashLSH16 uses 16-bit hash values and pre-allocation of hash tables.
 // MinHash signatures with 64 or 32 bit hash values will have
 // their hash values trimed.
-func NewMinhashLSH16(numHash int, threshold float64, initSize int) *MinhashLSH {
-	return newMinhashLSH(threshold, numHash, 2, initSize)
+func NewMinhashLSH16(numHash int, threshold float64, initSize int, opts ...Option) *MinhashLSH {
+	return newMinhashLSH(threshold, numHash, 2, initSize, opts)
+}
+
+// NewMinhashLSHBounded creates an index with 32 bit hash values like
+// NewMinhashLSH that holds at most maxKeys keys, at least one, as a
+// similarity cache of fixed size. When Add inserts a new key into a full
+// index, the least recently used key is evicted, i.e. removed from all
+// bands as by Remove. A key is used when it is added, and when it is
+// returned as a candidate by a query, so queries also update the
+// eviction order and take a lock shared with Add. Keys evicted before
+// Index is called are never searchable. The bound and the eviction order
+// are not saved by MarshalBinary and Save.
+func NewMinhashLSHBounded(numHash int, threshold float64, maxKeys int, opts ...Option) *MinhashLSH {
+	if maxKeys < 1 {
+		maxKeys = 1
+	}
+	f := newMinhashLSH(threshold, numHash, 4, maxKeys+1, opts)
+	f.lru = list.New()
+	f.lruElements = make(map[interface{}]*list.Element, maxKeys+1)
+	f.maxKeys = maxKeys
+	return f
 }
 
 // NewMinhashLSH is the default constructor uses 32 bit hash value
@@ -155,36 +533,1074 @@ func (f *MinhashLSH) Params() (k, l int) {
 	return f.k, f.l
 }
 
+// BandSegments returns the l segments of k hash values of the signature
+// the hash keys of the bands are made of, the i-th segment being the hash
+// values i*k to (i+1)*k-1. k*l is at most the number of hash functions,
+// and when it is less, e.g. as the number of hash functions is not a
+// multiple of k, the hash values past the last band are not used by the
+// index, unless it is created with PadLeftoverHashValues, in which case
+// the last segment is the shorter segment of the leftover hash values,
+// before padding. The segments are slices of sig, not copies. It panics
+// if the signature is shorter than the bands.
+func (f *MinhashLSH) BandSegments(sig []uint64) [][]uint64 {
+	end := f.k * f.l
+	if end > f.numHash {
+		end = f.numHash
+	}
+	if len(sig) < end {
+		panic("Signature is shorter than the bands of the index")
+	}
+	segments := make([][]uint64, f.l)
+	for i := range segments {
+		if (i+1)*f.k > end {
+			segments[i] = sig[i*f.k : end]
+		} else {
+			segments[i] = sig[i*f.k : (i+1)*f.k]
+		}
+	}
+	return segments
+}
+
+// FalsePositiveRate returns the probability that a key whose Jaccard
+// similarity with the query is belowThresholdSim is returned as a
+// candidate, computed as 1-(1-s^k)^l using the index's k and l.
+func (f *MinhashLSH) FalsePositiveRate(belowThresholdSim float64) float64 {
+	return falsePositive(f.l, f.k)(belowThresholdSim)
+}
+
+// FalseNegativeRate returns the probability that a key whose Jaccard
+// similarity with the query is aboveThresholdSim is not returned as a
+// candidate, computed as (1-s^k)^l using the index's k and l.
+func (f *MinhashLSH) FalseNegativeRate(aboveThresholdSim float64) float64 {
+	return falseNegative(f.l, f.k)(aboveThresholdSim)
+}
+
+// ExpectedRecallAtThreshold returns the probability that a key whose
+// Jaccard similarity with the query is exactly the threshold of the index
+// is returned as a candidate, computed as 1-(1-t^k)^l.
+func (f *MinhashLSH) ExpectedRecallAtThreshold() float64 {
+	return falsePositive(f.l, f.k)(f.threshold)
+}
+
 func (f *MinhashLSH) hashKeys(sig []uint64) []string {
 	hs := make([]string, f.l)
 	for i := 0; i < f.l; i++ {
-		hs[i] = f.hashKeyFunc(sig[i*f.k : (i+1)*f.k])
+		hs[i] = f.bandKey(i, sig)
 	}
 	return hs
 }
 
 // Add a key with MinHash signature into the index.
 // The key won't be searchable until Index() is called.
-func (f *MinhashLSH) Add(key interface{}, sig []uint64) {
+// Add is safe to call from multiple goroutines concurrently,
+// each band's hash table is guarded by its own lock so writers
+// only contend when inserting into the same band.
+// It must not be called concurrently with Index or Query.
+// An error is only returned for a key already in the index
+// when the index is created with RejectDuplicateKeys.
+func (f *MinhashLSH) Add(key interface{}, sig []uint64) error {
+	if f.skipEmpty && isEmptySignature(sig) {
+		return nil
+	}
 	// Generate hash keys
 	hs := f.hashKeys(sig)
+	f.keysLock.Lock()
+	// Unless duplicate keys are allowed, keysLock is held for the
+	// whole Add so no other Add sees the key half added.
+	held := f.duplicatePolicy != AllowDuplicateKeys || f.coalesce
+	if f.coalesce {
+		if _, exist := f.aliasOf[key]; exist {
+			if f.duplicatePolicy == RejectDuplicateKeys {
+				f.keysLock.Unlock()
+				return ErrDuplicateKey
+			}
+			f.removeAlias(key)
+		}
+		if f.addAlias(key, hs, sig) {
+			f.keysLock.Unlock()
+			return nil
+		}
+	}
+	if _, exist := f.members[key]; exist && f.duplicatePolicy != AllowDuplicateKeys {
+		if f.duplicatePolicy == RejectDuplicateKeys {
+			f.keysLock.Unlock()
+			return ErrDuplicateKey
+		}
+		f.removeKey(key)
+	}
+	f.addMember(key, hs, sig)
+	if !held {
+		f.keysLock.Unlock()
+	}
 	// Insert keys into the hash tables by appending.
 	for i := range f.hashTables {
+		f.locks[i].Lock()
 		f.hashTables[i] = append(f.hashTables[i], entry{hs[i], key})
+		f.locks[i].Unlock()
+	}
+	if f.lru != nil {
+		if !held {
+			f.keysLock.Lock()
+			held = true
+		}
+		f.touch(key)
+		for f.lru.Len() > f.maxKeys {
+			f.removeKey(f.lru.Back().Value)
+		}
+	}
+	if held {
+		f.keysLock.Unlock()
+	}
+	return nil
+}
+
+// Remove removes the key from the index, including all of its signatures
+// if it was added more than once, and returns false if the key is not in
+// the index. It must not be called concurrently with other methods.
+func (f *MinhashLSH) Remove(key interface{}) bool {
+	f.keysLock.Lock()
+	defer f.keysLock.Unlock()
+	if _, exist := f.aliasOf[key]; exist {
+		f.removeAlias(key)
+		return true
+	}
+	if _, exist := f.members[key]; !exist {
+		return false
+	}
+	f.removeKey(key)
+	return true
+}
+
+// removeKey removes the key from the hash tables and everything recorded
+// about it, the caller must hold keysLock.
+func (f *MinhashLSH) removeKey(key interface{}) {
+	if f.coalesce {
+		if len(f.aliases[key]) > 0 {
+			f.promoteAlias(key)
+			return
+		}
+		f.releaseSignatures(key)
+	}
+	f.removeEntries(key, f.members[key])
+	delete(f.members, key)
+	delete(f.signatures, key)
+	delete(f.values, key)
+	delete(f.sizes, key)
+	delete(f.elements, key)
+	if f.lru != nil {
+		if e, exist := f.lruElements[key]; exist {
+			f.lru.Remove(e)
+			delete(f.lruElements, key)
+		}
+	}
+}
+
+// touch marks the key as the most recently used one,
+// the caller must hold keysLock.
+func (f *MinhashLSH) touch(key interface{}) {
+	if e, exist := f.lruElements[key]; exist {
+		f.lru.MoveToFront(e)
+		return
+	}
+	f.lruElements[key] = f.lru.PushFront(key)
+}
+
+// AddWithValue adds a key with MinHash signature into the index like Add,
+// and associates the value with the key, so QueryValues returns it with
+// the key, e.g. a URL that would otherwise be looked up by the key.
+// A later AddWithValue of the same key replaces its value.
+// Values are kept in memory only, they are not saved by MarshalBinary
+// and Save.
+func (f *MinhashLSH) AddWithValue(key interface{}, sig []uint64, value interface{}) error {
+	if err := f.Add(key, sig); err != nil {
+		return err
+	}
+	f.keysLock.Lock()
+	defer f.keysLock.Unlock()
+	// The key is not added for an empty signature with SkipEmptySignatures.
+	if f.contains(key) {
+		if f.values == nil {
+			f.values = make(map[interface{}]interface{})
+		}
+		f.values[key] = value
+	}
+	return nil
+}
+
+// AddWithSize adds a key with MinHash signature into the index like Add,
+// and records the size of its set, so QueryWithSizes returns it with the
+// key, e.g. for ranking the candidates by containment.
+// A later AddWithSize of the same key replaces its size.
+// Sizes are kept in memory only, they are not saved by MarshalBinary
+// and Save.
+func (f *MinhashLSH) AddWithSize(key interface{}, sig []uint64, size int) error {
+	if err := f.Add(key, sig); err != nil {
+		return err
+	}
+	f.keysLock.Lock()
+	defer f.keysLock.Unlock()
+	// The key is not added for an empty signature with SkipEmptySignatures.
+	if f.contains(key) {
+		if f.sizes == nil {
+			f.sizes = make(map[interface{}]int)
+		}
+		f.sizes[key] = size
+	}
+	return nil
+}
+
+// AddWithElements adds a key with the MinHash signature of its elements
+// into the index like Add, and keeps a copy of the elements when the index
+// is created with the RetainElements option.
+// A later AddWithElements of the same key replaces its elements.
+func (f *MinhashLSH) AddWithElements(key interface{}, sig []uint64, elements [][]byte) error {
+	if err := f.Add(key, sig); err != nil {
+		return err
+	}
+	if f.elements == nil {
+		return nil
+	}
+	retained := make([][]byte, len(elements))
+	for i, e := range elements {
+		retained[i] = append([]byte(nil), e...)
+	}
+	f.keysLock.Lock()
+	defer f.keysLock.Unlock()
+	// The key is not added for an empty signature with SkipEmptySignatures.
+	if f.contains(key) {
+		f.elements[key] = retained
+	}
+	return nil
+}
+
+// addMember records the hash keys and the signature of an added key,
+// the caller must hold keysLock.
+func (f *MinhashLSH) addMember(key interface{}, hashKeys []string, sig []uint64) {
+	f.members[key] = append(f.members[key], hashKeys...)
+	if f.signatures != nil {
+		f.signatures[key] = append([]uint64(nil), sig...)
+	}
+	if f.coalesce {
+		sigKey := strings.Join(hashKeys, "")
+		if _, exist := f.sigOwners[sigKey]; !exist {
+			f.sigOwners[sigKey] = key
+		}
+	}
+}
+
+// removeEntries removes all the entries of key from the hash tables,
+// hashKeys are the hash keys of the key as recorded in members.
+// The indexed part of every hash table stays sorted.
+func (f *MinhashLSH) removeEntries(key interface{}, hashKeys []string) {
+	var numIndexedRemoved int
+	for i := range f.hashTables {
+		f.locks[i].Lock()
+		table := f.hashTables[i]
+		indexed := f.numIndexedKeys
+		for j := i; j < len(hashKeys); j += f.l {
+			hashKey := hashKeys[j]
+			// Look up the indexed part using binary search first.
+			x := sort.Search(indexed, func(x int) bool {
+				return table[x].hashKey >= hashKey
+			})
+			for ; x < indexed && table[x].hashKey == hashKey; x++ {
+				if table[x].key == key {
+					break
+				}
+			}
+			if x < indexed && table[x].hashKey == hashKey {
+				table = deleteEntry(table, x)
+				indexed--
+				continue
+			}
+			for x = indexed; x < len(table); x++ {
+				if table[x].hashKey == hashKey && table[x].key == key {
+					table = deleteEntry(table, x)
+					break
+				}
+			}
+		}
+		f.hashTables[i] = table
+		if i == 0 {
+			numIndexedRemoved = f.numIndexedKeys - indexed
+		}
+		f.locks[i].Unlock()
 	}
+	f.numIndexedKeys -= numIndexedRemoved
+}
+
+// deleteEntry removes the entry at position x keeping the order of the rest.
+func deleteEntry(table hashTable, x int) hashTable {
+	copy(table[x:], table[x+1:])
+	// Release the key for garbage collection.
+	table[len(table)-1] = entry{}
+	return table[:len(table)-1]
 }
 
 // Index makes all the keys added searchable.
+// It must be called after all concurrent calls to Add have returned.
 func (f *MinhashLSH) Index() {
+	var maxBucketSize int
 	for i := range f.hashTables {
+		f.locks[i].Lock()
 		sort.Sort(f.hashTables[i])
+		if f.trackStats {
+			if size := largestBucket(f.hashTables[i]); size > maxBucketSize {
+				maxBucketSize = size
+			}
+		}
+		f.locks[i].Unlock()
+	}
+	// Under keysLock for Stats.
+	f.keysLock.Lock()
+	f.numIndexedKeys = len(f.hashTables[0])
+	if f.trackStats {
+		f.maxBucketSize = maxBucketSize
+	}
+	f.keysLock.Unlock()
+	if f.crowdedLogger != nil {
+		f.warnCrowdedBucket()
+	}
+}
+
+// largestBucket returns the size of the largest bucket of the sorted
+// hash table.
+func largestBucket(table hashTable) int {
+	var maxSize int
+	for i := 0; i < len(table); {
+		j := i + 1
+		for j < len(table) && table[j].hashKey == table[i].hashKey {
+			j++
+		}
+		if j-i > maxSize {
+			maxSize = j - i
+		}
+		i = j
+	}
+	return maxSize
+}
+
+// TrackStats makes Index record the size of the largest bucket, reported
+// by Stats, at the cost of a scan of every hash table after sorting it.
+func TrackStats() Option {
+	return func(f *MinhashLSH) {
+		f.trackStats = true
+	}
+}
+
+// IndexStats are the size statistics of the index returned by Stats.
+type IndexStats struct {
+	// Keys is the number of distinct keys in the index, including the
+	// keys not indexed yet.
+	Keys int
+	// Entries is the number of entries of all hash tables, l for every
+	// time a key is added, including the entries not indexed yet.
+	Entries int
+	// IndexedEntries is the number of entries searchable by queries.
+	IndexedEntries int
+	// MaxBucketSize is the size of the largest bucket of any band as of
+	// the last call to Index. It is only tracked when the index is created
+	// with the TrackStats option, otherwise it is 0.
+	MaxBucketSize int
+}
+
+// Stats returns the size statistics of the index without scanning it,
+// e.g. to monitor a large build. It is safe to call concurrently with
+// Add and Index, in which case it reflects a state in between.
+func (f *MinhashLSH) Stats() IndexStats {
+	var stats IndexStats
+	f.keysLock.Lock()
+	stats.IndexedEntries = f.numIndexedKeys * len(f.hashTables)
+	stats.Keys = len(f.members) + len(f.aliasOf)
+	stats.MaxBucketSize = f.maxBucketSize
+	f.keysLock.Unlock()
+	// Counted after the indexed entries, so during a build there are
+	// never fewer entries than indexed entries.
+	for i := range f.hashTables {
+		f.locks[i].Lock()
+		stats.Entries += len(f.hashTables[i])
+		f.locks[i].Unlock()
+	}
+	return stats
+}
+
+// warnCrowdedBucket logs a warning if more than half of the entries of
+// the first band are in its largest bucket.
+func (f *MinhashLSH) warnCrowdedBucket() {
+	table := f.hashTables[0]
+	if len(table) < minCrowdedBucketSize {
+		return
+	}
+	var maxSize int
+	var maxHashKey string
+	for i := 0; i < len(table); {
+		j := i + 1
+		for j < len(table) && table[j].hashKey == table[i].hashKey {
+			j++
+		}
+		if j-i > maxSize {
+			maxSize, maxHashKey = j-i, table[i].hashKey
+		}
+		i = j
+	}
+	if maxSize*2 <= len(table) {
+		return
+	}
+	reason := "signatures may be identical"
+	// The hash values of empty signatures are all the maximum.
+	empty := make([]uint64, f.k)
+	for i := range empty {
+		empty[i] = math.MaxUint64
+	}
+	if maxHashKey == f.bandKey(0, empty) {
+		reason = "signatures may be empty, with no values pushed"
+	}
+	f.crowdedLogger.Printf("minhashlsh: %d of %d entries share one bucket, %s", maxSize, len(table), reason)
+}
+
+// Compact reclaims the memory left unused after many keys are removed,
+// by Remove, ReplaceDuplicateKeys or eviction. The hash tables are sorted
+// slices, so there are no empty buckets, but the slices keep their
+// capacity and Go maps do not shrink, so Compact copies the hash tables
+// into slices of their length and rebuilds the maps of the keys.
+// It is an O(total entries) maintenance operation that temporarily needs
+// memory for the copies, best run during quiet periods of long-lived
+// indexes with high turnover. Pending keys stay pending.
+// It must not be called concurrently with other methods.
+func (f *MinhashLSH) Compact() {
+	for i, table := range f.hashTables {
+		f.hashTables[i] = append(make(hashTable, 0, len(table)), table...)
+	}
+	members := make(map[interface{}][]string, len(f.members))
+	for key, hashKeys := range f.members {
+		members[key] = hashKeys
+	}
+	f.members = members
+	if f.signatures != nil {
+		signatures := make(map[interface{}][]uint64, len(f.signatures))
+		for key, sig := range f.signatures {
+			signatures[key] = sig
+		}
+		f.signatures = signatures
+	}
+	if f.values != nil {
+		values := make(map[interface{}]interface{}, len(f.values))
+		for key, value := range f.values {
+			values[key] = value
+		}
+		f.values = values
+	}
+	if f.sizes != nil {
+		sizes := make(map[interface{}]int, len(f.sizes))
+		for key, size := range f.sizes {
+			sizes[key] = size
+		}
+		f.sizes = sizes
+	}
+	if f.elements != nil {
+		elements := make(map[interface{}][][]byte, len(f.elements))
+		for key, e := range f.elements {
+			elements[key] = e
+		}
+		f.elements = elements
+	}
+	if f.coalesce {
+		sigOwners := make(map[string]interface{}, len(f.sigOwners))
+		for sigKey, key := range f.sigOwners {
+			sigOwners[sigKey] = key
+		}
+		f.sigOwners = sigOwners
+		aliases := make(map[interface{}][]interface{}, len(f.aliases))
+		for key, a := range f.aliases {
+			aliases[key] = a
+		}
+		f.aliases = aliases
+		aliasOf := make(map[interface{}]interface{}, len(f.aliasOf))
+		for alias, key := range f.aliasOf {
+			aliasOf[alias] = key
+		}
+		f.aliasOf = aliasOf
+	}
+	if f.lru != nil {
+		lruElements := make(map[interface{}]*list.Element, len(f.lruElements))
+		for key, e := range f.lruElements {
+			lruElements[key] = e
+		}
+		f.lruElements = lruElements
+	}
+}
+
+// BuildSorted adds the keys with their signatures into the index and
+// makes them searchable, the result is the same as calling Add for every
+// key followed by Index. Bands in which the new entries already appear
+// in hash key order, e.g. because the signatures were sorted by that
+// band, skip sorting and are merged into the index in linear time.
+// keys[i] is the key of sigs[i].
+func (f *MinhashLSH) BuildSorted(keys []interface{}, sigs [][]uint64) error {
+	if len(keys) != len(sigs) {
+		return errors.New("The number of keys and signatures must be the same")
+	}
+	if f.coalesce {
+		for i := range keys {
+			if err := f.Add(keys[i], sigs[i]); err != nil {
+				return err
+			}
+		}
+		f.Index()
+		return nil
+	}
+	if f.skipEmpty {
+		nonEmptyKeys := make([]interface{}, 0, len(keys))
+		nonEmptySigs := make([][]uint64, 0, len(sigs))
+		for i, sig := range sigs {
+			if !isEmptySignature(sig) {
+				nonEmptyKeys = append(nonEmptyKeys, keys[i])
+				nonEmptySigs = append(nonEmptySigs, sig)
+			}
+		}
+		keys, sigs = nonEmptyKeys, nonEmptySigs
+	}
+	f.keysLock.Lock()
+	defer f.keysLock.Unlock()
+	if f.duplicatePolicy != AllowDuplicateKeys {
+		// The position of the last occurrence of every key in the batch.
+		last := make(map[interface{}]int, len(keys))
+		for j, key := range keys {
+			_, exist := last[key]
+			_, member := f.members[key]
+			if f.duplicatePolicy == RejectDuplicateKeys && (exist || member) {
+				return ErrDuplicateKey
+			}
+			last[key] = j
+		}
+		uniqueKeys := make([]interface{}, 0, len(last))
+		uniqueSigs := make([][]uint64, 0, len(last))
+		for j, key := range keys {
+			if last[key] != j {
+				continue
+			}
+			if _, member := f.members[key]; member {
+				f.removeKey(key)
+			}
+			uniqueKeys = append(uniqueKeys, key)
+			uniqueSigs = append(uniqueSigs, sigs[j])
+		}
+		keys, sigs = uniqueKeys, uniqueSigs
+	}
+	batches := make([]hashTable, f.l)
+	for i := range batches {
+		batches[i] = make(hashTable, len(keys))
+	}
+	for j, sig := range sigs {
+		hs := f.hashKeys(sig)
+		for i, hashKey := range hs {
+			batches[i][j] = entry{hashKey, keys[j]}
+		}
+		f.addMember(keys[j], hs, sig)
+	}
+	for i, batch := range batches {
+		if !sort.IsSorted(batch) {
+			sort.Sort(batch)
+		}
+		f.locks[i].Lock()
+		if len(f.hashTables[i]) > f.numIndexedKeys {
+			// Keys added but not yet indexed, fall back to sorting all.
+			f.hashTables[i] = append(f.hashTables[i], batch...)
+			sort.Sort(f.hashTables[i])
+		} else {
+			f.hashTables[i] = mergeHashTables(f.hashTables[i], batch)
+		}
+		f.locks[i].Unlock()
 	}
 	f.numIndexedKeys = len(f.hashTables[0])
+	if f.lru != nil {
+		for _, key := range keys {
+			f.touch(key)
+		}
+		for f.lru.Len() > f.maxKeys {
+			f.removeKey(f.lru.Back().Value)
+		}
+	}
+	return nil
+}
+
+// mergeHashTables merges two sorted hash tables into a new sorted one.
+func mergeHashTables(a, b hashTable) hashTable {
+	merged := make(hashTable, 0, len(a)+len(b))
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if b[j].hashKey < a[i].hashKey {
+			merged = append(merged, b[j])
+			j++
+		} else {
+			merged = append(merged, a[i])
+			i++
+		}
+	}
+	merged = append(merged, a[i:]...)
+	return append(merged, b[j:]...)
+}
+
+// LoadFactor returns the average number of indexed entries per bucket,
+// averaged over the bands, as a single measure of how crowded the index
+// is. A query scans about this many entries per band for a key it finds,
+// so the query cost grows with it. It is 1 when every key has its own
+// bucket in every band, and grows with near-duplicate keys; values far
+// above the expected size of the groups of similar keys usually mean
+// skewed buckets, e.g. many empty or identical signatures.
+// It is 0 for an index with no indexed keys. It takes a scan of the
+// indexed entries and must not be called concurrently with Add or Index.
+func (f *MinhashLSH) LoadFactor() float64 {
+	if f.numIndexedKeys == 0 {
+		return 0
+	}
+	var sum float64
+	for _, table := range f.hashTables {
+		numBuckets := 1
+		for j := 1; j < f.numIndexedKeys; j++ {
+			if table[j].hashKey != table[j-1].hashKey {
+				numBuckets++
+			}
+		}
+		sum += float64(f.numIndexedKeys) / float64(numBuckets)
+	}
+	return sum / float64(f.l)
+}
+
+// ExpectedCandidatesPerQuery returns the expected number of entries a
+// query scans over all bands, i.e. the candidate comparisons, given the
+// current bucket sizes, assuming the query signatures are distributed like
+// the indexed ones, so a query lands in a bucket with a probability
+// proportional to its size. For every band this is the sum of the squared
+// bucket sizes over the number of indexed entries, so unlike LoadFactor
+// it weights the large buckets by how often queries hit them. A key
+// colliding with the query in several bands is counted once per band, so
+// it is an upper bound on the number of distinct candidates. It is 0 for
+// an index with no indexed keys. It takes a scan of the indexed entries
+// and must not be called concurrently with Add or Index.
+func (f *MinhashLSH) ExpectedCandidatesPerQuery() float64 {
+	if f.numIndexedKeys == 0 {
+		return 0
+	}
+	var sum float64
+	for _, table := range f.hashTables {
+		var sumSquares float64
+		for i := 0; i < f.numIndexedKeys; {
+			j := i + 1
+			for j < f.numIndexedKeys && table[j].hashKey == table[i].hashKey {
+				j++
+			}
+			sumSquares += float64(j-i) * float64(j-i)
+			i = j
+		}
+		sum += sumSquares / float64(f.numIndexedKeys)
+	}
+	return sum
+}
+
+// CardinalityStats returns the minimum, maximum and mean of the estimated
+// cardinalities of the sets represented by the stored signatures.
+// It requires the index to be created with the StoreSignatures option,
+// otherwise, or when the index is empty, all values are 0.
+func (f *MinhashLSH) CardinalityStats() (min, max, mean float64) {
+	if len(f.signatures) == 0 {
+		return 0, 0, 0
+	}
+	min = math.Inf(1)
+	for _, sig := range f.signatures {
+		c := cardinality(sig)
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+		mean += c
+	}
+	mean /= float64(len(f.signatures))
+	return min, max, mean
+}
+
+// RehashKeyWidth recomputes all hash keys using bytesPerValue bytes of
+// every hash value, as if the index was created by the constructor with
+// that hash value size, e.g. 8 for NewMinhashLSH64 and 2 for
+// NewMinhashLSH16. Widths from 1 to 8 bytes are supported.
+// Narrowing the width only needs the current hash keys. Widening needs
+// the full hash values, so it requires the index to be created with the
+// StoreSignatures option, and it fails if a key was added more than once,
+// as only its last signature is stored, or if the index has aliases of
+// CoalesceIdenticalSignatures, whose signatures may differ in the wider
+// hash values. New keys are coalesced by the new hash keys.
+// It must not be called concurrently with other methods.
+func (f *MinhashLSH) RehashKeyWidth(bytesPerValue int) error {
+	if err := checkWidth(bytesPerValue); err != nil {
+		return err
+	}
+	if f.hashedKeys {
+		return errors.New("Cannot rehash hashed band keys")
+	}
+	rehash := func(key interface{}, band int, hashKey string) string {
+		return truncateHashKey(hashKey, f.hashValueSize, bytesPerValue)
+	}
+	if bytesPerValue > f.hashValueSize {
+		if f.signatures == nil {
+			return errors.New("Widening hash keys requires stored signatures")
+		}
+		for key, hashKeys := range f.members {
+			if len(hashKeys) != f.l {
+				return fmt.Errorf("Cannot widen hash keys, key %v was added more than once", key)
+			}
+		}
+		// The signatures of aliases may differ from those of their keys
+		// in the wider hash values.
+		if len(f.aliasOf) > 0 {
+			return errors.New("Cannot widen hash keys of an index with aliases")
+		}
+		// Nothing fails past this point, so the wider hash keys can be
+		// made by bandKey right away.
+		f.hashKeyFunc = hashKeyFuncGen(bytesPerValue)
+		rehash = func(key interface{}, band int, hashKey string) string {
+			return f.bandKey(band, f.signatures[key])
+		}
+	}
+	for i, table := range f.hashTables {
+		for j := range table {
+			table[j].hashKey = rehash(table[j].key, i, table[j].hashKey)
+		}
+		sort.Sort(table[:f.numIndexedKeys])
+	}
+	for key, hashKeys := range f.members {
+		for j := range hashKeys {
+			hashKeys[j] = rehash(key, j%f.l, hashKeys[j])
+		}
+	}
+	f.hashValueSize = bytesPerValue
+	f.hashKeyFunc = hashKeyFuncGen(bytesPerValue)
+	if f.coalesce {
+		f.rebuildSigOwners()
+	}
+	return nil
+}
+
+// RecomputeSignatures recomputes the signatures of all keys from their
+// retained elements using NewMinhash(seed, numHash), and rebuilds the
+// index with them, choosing k and l for the new number of hash functions.
+// It requires the index to be created with the RetainElements option and
+// every key to be added with AddWithElements, a key added more than once
+// gets a single signature of its last elements. All keys are indexed
+// afterwards, and queries must use signatures of the new seed and number
+// of hash functions, which QuerySet does if the index has a SignatureSeed.
+// It must not be called concurrently with other methods.
+func (f *MinhashLSH) RecomputeSignatures(seed int64, numHash int) error {
+	if f.elements == nil {
+		return errors.New("Recomputing signatures requires retained elements")
+	}
+	if k, l, _ := bandParams(numHash, f.threshold); f.leftover == RejectLeftoverHashValues && k*l != numHash {
+		return fmt.Errorf("Number of hash functions %d is not a multiple of k = %d", numHash, k)
+	}
+	addedKeys := make([]interface{}, 0, len(f.members))
+	sets := make([][][]byte, 0, len(f.members))
+	for key := range f.members {
+		elements, exist := f.elements[key]
+		if !exist {
+			return fmt.Errorf("Cannot recompute signatures, key %v has no retained elements", key)
+		}
+		addedKeys = append(addedKeys, key)
+		sets = append(sets, elements)
+	}
+	for key := range f.aliasOf {
+		elements, exist := f.elements[key]
+		if !exist {
+			return fmt.Errorf("Cannot recompute signatures, key %v has no retained elements", key)
+		}
+		addedKeys = append(addedKeys, key)
+		sets = append(sets, elements)
+	}
+	g := newMinhashLSH(f.threshold, numHash, f.hashValueSize, len(addedKeys),
+		[]Option{LeftoverHashValues(f.leftover)})
+	g.skipEmpty = f.skipEmpty
+	g.hashedKeys, g.hashKeyFunc = f.hashedKeys, f.hashKeyFunc
+	if f.bandSeeds != nil {
+		BandSeeds(f.bandSeed)(g)
+	}
+	if f.hasSigSeed {
+		SignatureSeed(seed)(g)
+	}
+	if f.coalesce {
+		CoalesceIdenticalSignatures()(g)
+	}
+	if f.signatures != nil {
+		g.signatures = make(map[interface{}][]uint64, len(addedKeys))
+	}
+	for i, sig := range Signatures(sets, seed, numHash, 1) {
+		g.Add(addedKeys[i], sig)
+	}
+	g.Index()
+	f.k, f.l, f.numHash = g.k, g.l, g.numHash
+	f.hashTables = g.hashTables
+	f.numIndexedKeys = g.numIndexedKeys
+	f.locks = g.locks
+	f.members = g.members
+	f.signatures = g.signatures
+	f.sigOwners, f.aliases, f.aliasOf = g.sigOwners, g.aliases, g.aliasOf
+	if f.lru != nil {
+		// Keys may have become aliases or indexed keys.
+		for key, e := range f.lruElements {
+			if _, exist := f.members[key]; !exist {
+				f.lru.Remove(e)
+				delete(f.lruElements, key)
+			}
+		}
+		for key := range f.members {
+			if _, exist := f.lruElements[key]; !exist {
+				f.lruElements[key] = f.lru.PushBack(key)
+			}
+		}
+	}
+	return nil
+}
+
+// truncateHashKey keeps the lowest newWidth bytes of every hash value
+// in a hash key using width bytes per hash value.
+func truncateHashKey(hashKey string, width, newWidth int) string {
+	n := len(hashKey) / width
+	b := make([]byte, n*newWidth)
+	for i := 0; i < n; i++ {
+		copy(b[i*newWidth:(i+1)*newWidth], hashKey[i*width:i*width+newWidth])
+	}
+	return string(b)
+}
+
+// ExportBands returns a copy of the indexed hash tables, one map per band
+// from hash key to the keys in that bucket. Keys added after the last
+// call to Index are not included. Modifying the returned maps does not
+// affect the index.
+func (f *MinhashLSH) ExportBands() []map[string][]interface{} {
+	bands := make([]map[string][]interface{}, f.l)
+	for i := range f.hashTables {
+		bands[i] = make(map[string][]interface{})
+		for _, e := range f.hashTables[i][:f.numIndexedKeys] {
+			bands[i][e.hashKey] = append(bands[i][e.hashKey], e.key)
+		}
+	}
+	return bands
 }
 
 // Query returns candidate keys given the query signature.
 func (f *MinhashLSH) Query(sig []uint64) []interface{} {
-	set := f.query(sig)
+	return keys(f.query(sig, queryOptions{}))
+}
+
+// QueryExcluding returns candidate keys given the query signature,
+// leaving out the key exclude. It is useful for skipping the query's
+// own key when the query signature is also in the index.
+func (f *MinhashLSH) QueryExcluding(sig []uint64, exclude interface{}) []interface{} {
+	return f.QueryExcludingFunc(sig, exclude, nil)
+}
+
+// QueryExcludingFunc is like QueryExcluding but leaves out the keys for
+// which equal(key, exclude) returns true, for keys such as pointers or
+// structs whose identity is not ==. If equal is nil, == is used.
+func (f *MinhashLSH) QueryExcludingFunc(sig []uint64, exclude interface{}, equal func(a, b interface{}) bool) []interface{} {
+	if equal == nil {
+		return keys(f.query(sig, queryOptions{skip: func(key interface{}) bool {
+			return key == exclude
+		}}))
+	}
+	return keys(f.query(sig, queryOptions{skip: func(key interface{}) bool {
+		return equal(key, exclude)
+	}}))
+}
+
+// QueryFilter returns the candidate keys given the query signature for
+// which keep returns true, e.g. the keys of the same tenant. The keys are
+// filtered as the buckets are scanned, so the keys left out never make it
+// into the candidates. keep may be called more than once for a key that
+// collides with the query in several bands. If keep is nil, all
+// candidates are returned as in Query.
+func (f *MinhashLSH) QueryFilter(sig []uint64, keep func(key interface{}) bool) []interface{} {
+	if keep == nil {
+		return f.Query(sig)
+	}
+	return keys(f.query(sig, queryOptions{skip: func(key interface{}) bool {
+		return !keep(key)
+	}}))
+}
+
+// QueryBatch returns the candidate keys of every query signature, the i-th
+// result belongs to sigs[i]. The queries are run in parallel using up to
+// GOMAXPROCS goroutines. It must not be called concurrently with Add.
+func (f *MinhashLSH) QueryBatch(sigs [][]uint64) [][]interface{} {
+	// Index once for the batch, as concurrent queries cannot index.
+	if f.autoIndex && len(f.hashTables[0]) > f.numIndexedKeys {
+		f.Index()
+	}
+	results := make([][]interface{}, len(sigs))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(sigs) {
+		workers = len(sigs)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		// Each worker queries every workers-th signature.
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(sigs); i += workers {
+				results[i] = keys(f.query(sigs[i], queryOptions{}))
+			}
+		}(w)
+	}
+	wg.Wait()
+	return results
+}
+
+// FindCrossMatches returns the keys of index a that have candidates in
+// index b, e.g. to link near-duplicates across two corpora, mapping each
+// to its candidate keys in b. Every signature stored in a is used to query
+// b, so a must be created with the StoreSignatures option, and both
+// indexes must hold signatures of the same seed. It panics without stored
+// signatures, or if the indexes have different numbers of hash functions
+// or thresholds. It must not be called concurrently with Add on a.
+func FindCrossMatches(a, b *MinhashLSH) map[interface{}][]interface{} {
+	if a.signatures == nil {
+		panic("Cannot find cross matches without stored signatures")
+	}
+	if a.numHash != b.numHash || a.threshold != b.threshold {
+		panic("Cannot find cross matches between indexes of different parameters")
+	}
+	a.keysLock.Lock()
+	queryKeys := make([]interface{}, 0, len(a.signatures))
+	sigs := make([][]uint64, 0, len(a.signatures))
+	for key, sig := range a.signatures {
+		queryKeys = append(queryKeys, key)
+		sigs = append(sigs, sig)
+	}
+	a.keysLock.Unlock()
+	matches := make(map[interface{}][]interface{})
+	for i, candidates := range b.QueryBatch(sigs) {
+		if len(candidates) > 0 {
+			matches[queryKeys[i]] = candidates
+		}
+	}
+	return matches
+}
+
+// QueryLimit returns at most maxResults candidate keys given the query
+// signature, it stops gathering candidates once maxResults distinct keys
+// are found, bounding the work of queries with large buckets at the cost
+// of completeness. Which candidates are returned when there are more than
+// maxResults depends on the bucket contents, so the results are an
+// arbitrary subset that should not be relied upon to be deterministic.
+func (f *MinhashLSH) QueryLimit(sig []uint64, maxResults int) []interface{} {
+	if maxResults <= 0 {
+		return []interface{}{}
+	}
+	return keys(f.query(sig, queryOptions{limit: maxResults}))
+}
+
+// QueryPrefix returns candidate keys given the query signature, probing
+// only the first bands of the L band tables, so only the first bands*k
+// hash values of the signature are used and it can be that short.
+// Fewer bands make the query cheaper but lower its recall, as a key is
+// only found if it collides with the query in one of the probed bands,
+// so it suits a first-pass filter refined by a query with the full
+// signature. With bands of L or more all bands are probed, as in Query.
+func (f *MinhashLSH) QueryPrefix(sig []uint64, bands int) []interface{} {
+	if bands <= 0 {
+		return []interface{}{}
+	}
+	return keys(f.query(sig, queryOptions{bands: bands}))
+}
+
+// QueryBruteForce returns candidate keys given the query signature, where
+// a key collides with the query in a band if at most maxMismatchPerBand
+// of the k hash values of the band differ, e.g. k-1 matching values for a
+// tolerance of 1, which raises the recall of pairs of lower similarity.
+// It does not use the hash tables, which only find exact band matches, as
+// the neighborhood of a band key cannot be enumerated for hash values of
+// up to 64 bits: for a positive tolerance it is a linear scan of the
+// stored signatures of all keys, which requires the StoreSignatures
+// option and costs O(keys * numHash) per query, so it is only meant for
+// small indexes or occasional queries, not in place of Query. This also
+// finds the keys added since the last call to Index, and a key added more
+// than once is only compared using its last signature. The number of
+// candidates grows quickly with the tolerance, with a tolerance of k
+// every key is a candidate. With a tolerance of 0 it is the same as Query.
+func (f *MinhashLSH) QueryBruteForce(sig []uint64, maxMismatchPerBand int) ([]interface{}, error) {
+	if maxMismatchPerBand <= 0 {
+		return f.Query(sig), nil
+	}
+	if f.signatures == nil {
+		return nil, errors.New("Brute force queries require stored signatures")
+	}
+	if f.skipEmpty && isEmptySignature(sig) {
+		return []interface{}{}, nil
+	}
+	var results []interface{}
+	for key, stored := range f.signatures {
+		for i := 0; i < f.l; i++ {
+			var mismatches int
+			for j := i * f.k; j < (i+1)*f.k && j < f.numHash && mismatches <= maxMismatchPerBand; j++ {
+				if sig[j] != stored[j] {
+					mismatches++
+				}
+			}
+			if mismatches <= maxMismatchPerBand {
+				results = append(results, key)
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// QueryCount returns the number of distinct candidate keys given the
+// query signature, without creating the list of candidates. Combined with
+// QueryLimit, QueryCount(sig) > 0 is a cheap check for near-duplicates.
+// The candidates are only gathered to count them if they are found in
+// more than one band, or in one band of an index allowing duplicate keys.
+func (f *MinhashLSH) QueryCount(sig []uint64) int {
+	buckets, maxBucketSize := f.lookupBuckets(sig, queryOptions{})
+	var found hashTable
+	var numFound int
+	for _, bucket := range buckets {
+		if len(bucket) > 0 {
+			found = bucket
+			numFound++
+		}
+	}
+	if numFound == 0 {
+		return 0
+	}
+	// Without duplicate keys, the keys of a bucket are distinct, unless
+	// the LRU or the aliases need the candidates.
+	if numFound == 1 && f.duplicatePolicy != AllowDuplicateKeys &&
+		f.lru == nil && !(f.coalesce && len(f.aliases) > 0) {
+		return len(found)
+	}
+	return len(f.gather(buckets, maxBucketSize, queryOptions{}))
+}
+
+// QueryStats describes the work done by a query.
+type QueryStats struct {
+	// EntriesScanned is the total number of bucket entries examined
+	// across all bands.
+	EntriesScanned int
+	// Candidates is the number of distinct candidate keys.
+	Candidates int
+}
+
+// QueryWithStats returns candidate keys given the query signature,
+// and the statistics of the query, which can be used to detect
+// queries with abnormally large fan-out.
+func (f *MinhashLSH) QueryWithStats(sig []uint64) ([]interface{}, QueryStats) {
+	var stats QueryStats
+	results := keys(f.query(sig, queryOptions{stats: &stats}))
+	return results, stats
+}
+
+func keys(set map[interface{}]int) []interface{} {
 	results := make([]interface{}, 0, len(set))
 	for key := range set {
 		results = append(results, key)
@@ -192,26 +1608,561 @@ func (f *MinhashLSH) Query(sig []uint64) []interface{} {
 	return results
 }
 
-func (f *MinhashLSH) query(sig []uint64) map[interface{}]bool {
-	// Generate hash keys.
+// QueryMinhash returns candidate keys given the query Minhash.
+// It panics if the number of hash functions of the Minhash is different
+// from the one the index is created with, or, for an index created with
+// the SignatureSeed option, if the Minhash has different seeds, as its
+// signature is not comparable with those of the index.
+func (f *MinhashLSH) QueryMinhash(m *Minhash) []interface{} {
+	if m.NumHash() != f.numHash {
+		panic("Cannot query with Minhash of different number of hash functions")
+	}
+	if f.hasSigSeed {
+		seed1, seed2 := m.Seeds()
+		if seed1 != f.sigSeed1 || seed2 != f.sigSeed2 {
+			panic("Cannot query with Minhash of different seed")
+		}
+	}
+	return f.Query(m.Signature())
+}
+
+// QuerySet returns candidate keys given the elements of the query set,
+// whose signature is computed with the seed and number of hash functions
+// of the index, as NewMinhash(seed, numHash) with every element pushed.
+// It requires the index to be created with the SignatureSeed option, and
+// panics otherwise.
+func (f *MinhashLSH) QuerySet(elements [][]byte) []interface{} {
+	if !f.hasSigSeed {
+		panic("Cannot query with a set without the signature seed")
+	}
+	m := NewMinhash(f.sigSeed, f.numHash)
+	for _, e := range elements {
+		m.Push(e)
+	}
+	return f.Query(m.Signature())
+}
+
+// BucketMates returns the other keys sharing at least one band bucket
+// with the key, which is found without a query signature. Only indexed
+// keys are considered, and no keys are returned for a key not in the index.
+func (f *MinhashLSH) BucketMates(key interface{}) []interface{} {
+	f.keysLock.Lock()
+	hashKeys := f.members[key]
+	f.keysLock.Unlock()
+	mates := make(map[interface{}]int)
+	for j, hashKey := range hashKeys {
+		for _, e := range f.bucket(j%f.l, hashKey) {
+			if e.key != key {
+				mates[e.key]++
+			}
+		}
+	}
+	return keys(mates)
+}
+
+// QueryByBand returns the candidate keys found in the bucket of each of
+// the L bands given the query signature, the i-th slice holds the keys
+// colliding with the query in the i-th band, and a key colliding in
+// several bands appears in each of them. It shows which bands contribute
+// which candidates, e.g. for studying the sensitivity to k and l.
+func (f *MinhashLSH) QueryByBand(sig []uint64) [][]interface{} {
+	if f.autoIndex && len(f.hashTables[0]) > f.numIndexedKeys {
+		f.Index()
+	}
+	bands := make([][]interface{}, f.l)
+	if f.skipEmpty && isEmptySignature(sig) {
+		return bands
+	}
+	for i, hashKey := range f.hashKeys(sig) {
+		seen := make(map[interface{}]int)
+		for _, e := range f.bucket(i, hashKey) {
+			seen[e.key]++
+		}
+		bands[i] = keys(seen)
+	}
+	return bands
+}
+
+// BandExplanation is a band in which candidates collide with the query
+// signature, returned by QueryExplain.
+type BandExplanation struct {
+	// Band is the index of the band, from 0 to l-1.
+	Band int
+	// HashKey is the binary hash key of the band of the query signature,
+	// shared by the candidates.
+	HashKey string
+	// Candidates are the keys in the bucket of the band, ordered as by
+	// SortResults, so the first is the most similar one. Their
+	// BandMatches count all the bands they collide in.
+	Candidates []Result
+}
+
+// QueryExplain returns the bands in which candidates collide with the
+// query signature, in band order, each with its hash key and candidates,
+// e.g. to show why keys are candidates. The similarities are only
+// available when the index is created with the StoreSignatures option,
+// otherwise they are 0.
+func (f *MinhashLSH) QueryExplain(sig []uint64) []BandExplanation {
+	if f.autoIndex && len(f.hashTables[0]) > f.numIndexedKeys {
+		f.Index()
+	}
+	if f.skipEmpty && isEmptySignature(sig) {
+		return []BandExplanation{}
+	}
 	hashKeys := f.hashKeys(sig)
-	results := make(map[interface{}]bool)
-	// Query hash tables using binary search.
-	for i := 0; i < f.l; i++ {
-		// Only search over the indexed keys.
-		hashTable := f.hashTables[i][:f.numIndexedKeys]
-		hashKey := hashKeys[i]
-		k := sort.Search(len(hashTable), func(x int) bool {
-			return hashTable[x].hashKey >= hashKey
-		})
-		if k < len(hashTable) && hashTable[k].hashKey == hashKey {
-			for j := k; j < len(hashTable) && hashTable[j].hashKey == hashKey; j++ {
-				key := hashTable[j].key
-				if _, exist := results[key]; !exist {
-					results[key] = true
-				}
+	bands := make([]map[interface{}]int, len(hashKeys))
+	bandMatches := make(map[interface{}]int)
+	for i, hashKey := range hashKeys {
+		bands[i] = make(map[interface{}]int)
+		for _, e := range f.bucket(i, hashKey) {
+			bands[i][e.key]++
+		}
+		if f.coalesce && len(f.aliases) > 0 {
+			f.addAliases(bands[i], nil, 0)
+		}
+		for key := range bands[i] {
+			bandMatches[key]++
+		}
+	}
+	explanations := make([]BandExplanation, 0, len(bands))
+	for i, band := range bands {
+		if len(band) == 0 {
+			continue
+		}
+		candidates := make([]Result, 0, len(band))
+		for key := range band {
+			r := Result{Key: key, BandMatches: bandMatches[key]}
+			if stored, exist := f.signatures[key]; exist {
+				r.Similarity = f.similarity(sig, stored)
+			}
+			candidates = append(candidates, r)
+		}
+		SortResults(candidates)
+		explanations = append(explanations, BandExplanation{i, hashKeys[i], candidates})
+	}
+	return explanations
+}
+
+// KeyValue is a candidate key returned by QueryValues with its value.
+type KeyValue struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// QueryValues returns the candidate keys given the query signature with
+// the values associated by AddWithValue. The value of a key added with Add
+// only is nil.
+func (f *MinhashLSH) QueryValues(sig []uint64) []KeyValue {
+	candidates := f.query(sig, queryOptions{})
+	results := make([]KeyValue, 0, len(candidates))
+	for key := range candidates {
+		results = append(results, KeyValue{key, f.values[key]})
+	}
+	return results
+}
+
+// KeySize is a candidate key returned by QueryWithSizes with the size
+// of its set.
+type KeySize struct {
+	Key  interface{}
+	Size int
+}
+
+// QueryWithSizes returns the candidate keys given the query signature with
+// the set sizes recorded by AddWithSize. The size of a key added without
+// a size is -1.
+func (f *MinhashLSH) QueryWithSizes(sig []uint64) []KeySize {
+	candidates := f.query(sig, queryOptions{})
+	results := make([]KeySize, 0, len(candidates))
+	for key := range candidates {
+		size, exist := f.sizes[key]
+		if !exist {
+			size = -1
+		}
+		results = append(results, KeySize{key, size})
+	}
+	return results
+}
+
+// SamplePairs returns n random pairs of different keys sharing a bucket,
+// i.e. candidate pairs of the index, e.g. for labeling them to estimate
+// the precision of the index. A pair is drawn by picking a bucket holding
+// at least two different keys uniformly at random across all bands, then
+// two of its keys, with replacement, so the same pair can be drawn more
+// than once. Picking buckets first avoids over-sampling the largest
+// buckets, but biases the sample towards the pairs of small buckets
+// compared to sampling all candidate pairs uniformly. It returns no pairs
+// if n is not positive or no bucket holds two different keys. Only
+// indexed keys are sampled. It takes a scan of the indexed entries.
+func (f *MinhashLSH) SamplePairs(n int, rng *rand.Rand) [][2]interface{} {
+	if n <= 0 {
+		return nil
+	}
+	// The hash tables and ranges of the buckets with different keys.
+	type bucketRange struct {
+		table      hashTable
+		start, end int
+	}
+	var buckets []bucketRange
+	for _, table := range f.hashTables {
+		table = table[:f.numIndexedKeys]
+		for i := 0; i < len(table); {
+			j := i + 1
+			distinct := false
+			for j < len(table) && table[j].hashKey == table[i].hashKey {
+				distinct = distinct || table[j].key != table[i].key
+				j++
+			}
+			if distinct {
+				buckets = append(buckets, bucketRange{table, i, j})
 			}
+			i = j
 		}
 	}
+	if len(buckets) == 0 {
+		return nil
+	}
+	pairs := make([][2]interface{}, n)
+	for p := range pairs {
+		b := buckets[rng.Intn(len(buckets))]
+		size := b.end - b.start
+		x := b.table[b.start+rng.Intn(size)].key
+		y := x
+		for y == x {
+			y = b.table[b.start+rng.Intn(size)].key
+		}
+		pairs[p] = [2]interface{}{x, y}
+	}
+	return pairs
+}
+
+// Result is a candidate key returned by QueryDetailed.
+type Result struct {
+	// Key is the indexed key.
+	Key interface{}
+	// BandMatches is the number of bands in which the key
+	// collides with the query signature.
+	BandMatches int
+	// Similarity is the estimated Jaccard similarity between the
+	// signature of the key and the query signature, computed by the
+	// estimator of the index.
+	// It is only available when the index is created with the
+	// StoreSignatures option, otherwise it is 0.
+	Similarity float64
+}
+
+// QueryDetailed returns candidate keys given the query signature,
+// together with their band match counts and, when available,
+// their estimated similarities.
+func (f *MinhashLSH) QueryDetailed(sig []uint64) []Result {
+	set := f.query(sig, queryOptions{})
+	results := make([]Result, 0, len(set))
+	for key, bandMatches := range set {
+		r := Result{Key: key, BandMatches: bandMatches}
+		if stored, exist := f.signatures[key]; exist {
+			r.Similarity = f.similarity(sig, stored)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// QueryHistogram returns the candidate keys given the query signature
+// grouped by their estimated similarity, as computed by QueryDetailed,
+// candidates of similarity s being in the group floor(s/bucketWidth), e.g.
+// with a bucketWidth of 0.1, group 6 holds the similarities from 0.6 up to
+// 0.7, and group 10 those of 1. The similarities are only available when
+// the index is created with the StoreSignatures option, otherwise all
+// candidates are in group 0. It panics if bucketWidth is not positive.
+func (f *MinhashLSH) QueryHistogram(sig []uint64, bucketWidth float64) map[int][]interface{} {
+	if bucketWidth <= 0 {
+		panic("Bucket width must be positive")
+	}
+	groups := make(map[int][]interface{})
+	for _, r := range f.QueryDetailed(sig) {
+		// The tolerance keeps similarities on a boundary, e.g. 0.7 for a
+		// width of 0.1, from falling into the group below by rounding.
+		group := int(math.Floor(r.Similarity/bucketWidth + 1e-9))
+		groups[group] = append(groups[group], r.Key)
+	}
+	return groups
+}
+
+// QueryTopK returns the n candidate keys given the query signature that
+// are the most similar to it, ordered as by SortResults. The similarities
+// are only available when the index is created with the StoreSignatures
+// option, otherwise the candidates are only ordered by key.
+func (f *MinhashLSH) QueryTopK(sig []uint64, n int) []Result {
+	results := f.QueryDetailed(sig)
+	SortResults(results)
+	if n < len(results) {
+		results = results[:n]
+	}
+	if n <= 0 {
+		results = results[:0]
+	}
+	return results
+}
+
+// QueryAdaptive returns about targetCount candidate keys given the query
+// signature, ranked from the most similar, for a predictable number of
+// results instead of an absolute threshold. It starts strict, matching
+// whole bands, and while there are fewer than targetCount candidates it
+// relaxes the query by matching the hash keys of the bands on fewer of
+// their leading hash values, down to a single one, as in LSH Forest. The
+// candidates are ranked by estimated similarity when the index is created
+// with the StoreSignatures option, then by the number of leading hash
+// values they were first found with, then by the number of bands they
+// collide in, then by key as by SortResults, and at most targetCount of
+// them are returned. It under-shoots when the index has fewer keys close
+// enough to collide on the first hash value of any band, and relaxed
+// queries can scan many entries. With HashedBandKeys, the hash keys have
+// no prefixes to relax to, so only whole bands are matched.
+func (f *MinhashLSH) QueryAdaptive(sig []uint64, targetCount int) []interface{} {
+	if targetCount <= 0 {
+		return []interface{}{}
+	}
+	var candidates map[interface{}]int
+	depths := make(map[interface{}]int)
+	for depth := f.k; depth >= 1; depth-- {
+		candidates = f.query(sig, queryOptions{depth: depth})
+		for key := range candidates {
+			if _, exist := depths[key]; !exist {
+				depths[key] = depth
+			}
+		}
+		if len(candidates) >= targetCount || f.hashedKeys {
+			break
+		}
+	}
+	results := make([]adaptiveResult, 0, len(candidates))
+	for key, bandMatches := range candidates {
+		r := adaptiveResult{Result{Key: key, BandMatches: bandMatches}, depths[key]}
+		if stored, exist := f.signatures[key]; exist {
+			r.Similarity = f.similarity(sig, stored)
+		}
+		results = append(results, r)
+	}
+	sort.Sort(adaptiveOrder(results))
+	if len(results) > targetCount {
+		results = results[:targetCount]
+	}
+	ranked := make([]interface{}, len(results))
+	for i, r := range results {
+		ranked[i] = r.Key
+	}
+	return ranked
+}
+
+// adaptiveResult is a candidate of QueryAdaptive, with the number of
+// leading hash values of the bands it was first found with.
+type adaptiveResult struct {
+	Result
+	depth int
+}
+
+// adaptiveOrder ranks the results of QueryAdaptive.
+type adaptiveOrder []adaptiveResult
+
+func (r adaptiveOrder) Len() int      { return len(r) }
+func (r adaptiveOrder) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r adaptiveOrder) Less(i, j int) bool {
+	if r[i].Similarity != r[j].Similarity {
+		return r[i].Similarity > r[j].Similarity
+	}
+	if r[i].depth != r[j].depth {
+		return r[i].depth > r[j].depth
+	}
+	if r[i].BandMatches != r[j].BandMatches {
+		return r[i].BandMatches > r[j].BandMatches
+	}
+	return keyLess(r[i].Key, r[j].Key)
+}
+
+// SortResults sorts the results by descending similarity, and the results
+// of equal similarity, common with small signatures, by ascending key, so
+// the order is deterministic. Int keys are ordered by value before string
+// keys, which are ordered lexicographically, and keys of other types come
+// last, ordered by their Go-syntax representation (fmt's %#v).
+func SortResults(results []Result) {
+	sort.Sort(resultOrder(results))
+}
+
+type resultOrder []Result
+
+func (r resultOrder) Len() int      { return len(r) }
+func (r resultOrder) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r resultOrder) Less(i, j int) bool {
+	if r[i].Similarity != r[j].Similarity {
+		return r[i].Similarity > r[j].Similarity
+	}
+	return keyLess(r[i].Key, r[j].Key)
+}
+
+// keyLess orders keys as documented by SortResults.
+func keyLess(a, b interface{}) bool {
+	if x, ok := a.(int); ok {
+		if y, ok := b.(int); ok {
+			return x < y
+		}
+		return true
+	}
+	if _, ok := b.(int); ok {
+		return false
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+		return true
+	}
+	if _, ok := b.(string); ok {
+		return false
+	}
+	return fmt.Sprintf("%#v", a) < fmt.Sprintf("%#v", b)
+}
+
+// similarity estimates the similarity of two signatures from the number
+// of positions at which they agree, using the estimator of the index.
+func (f *MinhashLSH) similarity(sig1, sig2 []uint64) float64 {
+	n := len(sig1)
+	if len(sig2) < n {
+		n = len(sig2)
+	}
+	if n == 0 {
+		return 0
+	}
+	var matches int
+	for i := 0; i < n; i++ {
+		if sig1[i] == sig2[i] {
+			matches++
+		}
+	}
+	if f.estimator == nil {
+		return MatchFraction{}.Estimate(matches, n)
+	}
+	return f.estimator.Estimate(matches, n)
+}
+
+// bucket returns the indexed entries of band i with the hash key,
+// found using binary search.
+func (f *MinhashLSH) bucket(i int, hashKey string) hashTable {
+	// Only search over the indexed keys.
+	hashTable := f.hashTables[i][:f.numIndexedKeys]
+	start := sort.Search(len(hashTable), func(x int) bool {
+		return hashTable[x].hashKey >= hashKey
+	})
+	end := start
+	for end < len(hashTable) && hashTable[end].hashKey == hashKey {
+		end++
+	}
+	return hashTable[start:end]
+}
+
+// prefixBucket returns the indexed entries of the i-th band whose hash
+// keys start with the prefix, which are contiguous as the hash keys are
+// sorted.
+func (f *MinhashLSH) prefixBucket(i int, prefix string) hashTable {
+	hashTable := f.hashTables[i][:f.numIndexedKeys]
+	start := sort.Search(len(hashTable), func(x int) bool {
+		return hashTable[x].hashKey >= prefix
+	})
+	end := start
+	for end < len(hashTable) && strings.HasPrefix(hashTable[end].hashKey, prefix) {
+		end++
+	}
+	return hashTable[start:end]
+}
+
+// queryOptions changes how query gathers candidates.
+type queryOptions struct {
+	// skip leaves out the keys for which it returns true during the scan.
+	skip func(interface{}) bool
+	// stats is filled with the statistics of the query.
+	stats *QueryStats
+	// limit stops the scan once this many distinct keys are found,
+	// 0 means no limit.
+	limit int
+	// bands is the number of leading bands probed, 0 means all bands.
+	bands int
+	// depth is the number of leading hash values of every band that must
+	// match, 0 means all k hash values. It is ignored with hashed keys.
+	depth int
+}
+
+// lookupBuckets returns the buckets of the bands probed for the query
+// signature, none for an empty signature skipped by SkipEmptySignatures,
+// and the size of the largest of them.
+func (f *MinhashLSH) lookupBuckets(sig []uint64, opts queryOptions) ([]hashTable, int) {
+	if f.autoIndex && len(f.hashTables[0]) > f.numIndexedKeys {
+		f.Index()
+	}
+	if f.skipEmpty && isEmptySignature(sig) {
+		return nil, 0
+	}
+	numBands := f.l
+	if opts.bands > 0 && opts.bands < f.l {
+		numBands = opts.bands
+	}
+	buckets := make([]hashTable, numBands)
+	var maxBucketSize int
+	for i := range buckets {
+		if opts.depth > 0 && opts.depth < f.k && !f.hashedKeys {
+			buckets[i] = f.prefixBucket(i, f.bandKey(i, sig)[:opts.depth*f.hashValueSize])
+		} else {
+			buckets[i] = f.bucket(i, f.bandKey(i, sig))
+		}
+		if len(buckets[i]) > maxBucketSize {
+			maxBucketSize = len(buckets[i])
+		}
+	}
+	return buckets, maxBucketSize
+}
+
+// query returns the candidate keys and the number of bands
+// each of them collides with the query signature.
+func (f *MinhashLSH) query(sig []uint64, opts queryOptions) map[interface{}]int {
+	// Look up the buckets first, so the result map can be presized
+	// to the largest bucket, which is a lower bound of the number of
+	// candidates, to avoid growing it while gathering the candidates.
+	buckets, maxBucketSize := f.lookupBuckets(sig, opts)
+	return f.gather(buckets, maxBucketSize, opts)
+}
+
+// gather returns the keys of the buckets and the number of buckets each
+// of them is in.
+func (f *MinhashLSH) gather(buckets []hashTable, maxBucketSize int, opts queryOptions) map[interface{}]int {
+	if opts.limit > 0 && maxBucketSize > opts.limit {
+		maxBucketSize = opts.limit
+	}
+	results := make(map[interface{}]int, maxBucketSize)
+	var numScanned int
+scan:
+	for _, bucket := range buckets {
+		for _, e := range bucket {
+			numScanned++
+			if opts.skip != nil && opts.skip(e.key) {
+				continue
+			}
+			if _, exist := results[e.key]; !exist && opts.limit > 0 && len(results) >= opts.limit {
+				break scan
+			}
+			results[e.key]++
+		}
+	}
+	if f.lru != nil {
+		f.keysLock.Lock()
+		for key := range results {
+			f.touch(key)
+		}
+		f.keysLock.Unlock()
+	}
+	if f.coalesce && len(f.aliases) > 0 {
+		f.addAliases(results, opts.skip, opts.limit)
+	}
+	if opts.stats != nil {
+		opts.stats.EntriesScanned = numScanned
+		opts.stats.Candidates = len(results)
+	}
 	return results
 }
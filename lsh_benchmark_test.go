@@ -1,6 +1,7 @@
 package minhashlsh
 
 import (
+	"sort"
 	"strconv"
 	"testing"
 )
@@ -17,3 +18,362 @@ func Benchmark_Insert10000(b *testing.B) {
 	}
 	f.Index()
 }
+
+func benchmarkBuildData(n int) ([]interface{}, [][]uint64) {
+	keys := make([]interface{}, n)
+	sigs := make([][]uint64, n)
+	for i := range sigs {
+		keys[i] = strconv.Itoa(i)
+		sigs[i] = randomSignature(64, int64(i))
+	}
+	return keys, sigs
+}
+
+func Benchmark_AddIndex10000(b *testing.B) {
+	keys, sigs := benchmarkBuildData(10000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f := NewMinhashLSH16(64, 0.5, len(sigs))
+		for i := range sigs {
+			f.Add(keys[i], sigs[i])
+		}
+		f.Index()
+	}
+}
+
+// byBandKey sorts keys and their signatures by the hash key of a band.
+type byBandKey struct {
+	keys     []interface{}
+	sigs     [][]uint64
+	bandKeys []string
+}
+
+func (s byBandKey) Len() int           { return len(s.keys) }
+func (s byBandKey) Less(i, j int) bool { return s.bandKeys[i] < s.bandKeys[j] }
+func (s byBandKey) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.sigs[i], s.sigs[j] = s.sigs[j], s.sigs[i]
+	s.bandKeys[i], s.bandKeys[j] = s.bandKeys[j], s.bandKeys[i]
+}
+
+// benchmarkSortedData returns the data of benchmarkBuildData sorted by
+// the first band of the index, so BuildSorted skips sorting that band.
+func benchmarkSortedData(n int) ([]interface{}, [][]uint64) {
+	keys, sigs := benchmarkBuildData(n)
+	f := NewMinhashLSH16(64, 0.5, 0)
+	bandKeys := make([]string, n)
+	for i := range sigs {
+		bandKeys[i] = f.bandKey(0, sigs[i])
+	}
+	sort.Sort(byBandKey{keys, sigs, bandKeys})
+	return keys, sigs
+}
+
+func Benchmark_BuildSorted10000(b *testing.B) {
+	keys, sigs := benchmarkSortedData(10000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f := NewMinhashLSH16(64, 0.5, len(sigs))
+		f.BuildSorted(keys, sigs)
+	}
+}
+
+// Benchmark_AddIndexSorted10000 is the baseline of
+// Benchmark_BuildSorted10000, adding the same sorted input one key at a
+// time.
+func Benchmark_AddIndexSorted10000(b *testing.B) {
+	keys, sigs := benchmarkSortedData(10000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f := NewMinhashLSH16(64, 0.5, len(sigs))
+		for i := range sigs {
+			f.Add(keys[i], sigs[i])
+		}
+		f.Index()
+	}
+}
+
+// benchmarkQuery queries an index of 10000 keys in which every group of
+// bucketSize keys shares the same signature.
+func benchmarkQuery(bucketSize int, b *testing.B) {
+	numKeys := 10000
+	f := NewMinhashLSH16(64, 0.5, numKeys)
+	for i := 0; i < numKeys; i++ {
+		f.Add(i, randomSignature(64, int64(i/bucketSize)))
+	}
+	f.Index()
+	queries := make([][]uint64, 100)
+	for i := range queries {
+		queries[i] = randomSignature(64, int64(i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Query(queries[n%len(queries)])
+	}
+}
+
+func Benchmark_QueryBucket1(b *testing.B) {
+	benchmarkQuery(1, b)
+}
+
+func Benchmark_QueryBucket10(b *testing.B) {
+	benchmarkQuery(10, b)
+}
+
+func Benchmark_QueryBucket100(b *testing.B) {
+	benchmarkQuery(100, b)
+}
+
+func Benchmark_QueryBucket1000(b *testing.B) {
+	benchmarkQuery(1000, b)
+}
+
+func benchmarkBuild1M(initSize int, b *testing.B) {
+	numKeys := 1000000
+	sigs := make([][]uint64, numKeys)
+	for i := range sigs {
+		sigs[i] = randomSignature(16, int64(i))
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f := NewMinhashLSH16(16, 0.5, initSize)
+		for i := range sigs {
+			f.Add(i, sigs[i])
+		}
+		f.Index()
+	}
+}
+
+func Benchmark_Build1MWithoutInitSize(b *testing.B) {
+	benchmarkBuild1M(0, b)
+}
+
+func Benchmark_Build1MWithInitSize(b *testing.B) {
+	benchmarkBuild1M(1000000, b)
+}
+
+// perturbSignature returns a copy of sig with every n-th hash value changed,
+// so its similarity with sig is about 1-1/n.
+func perturbSignature(sig []uint64, n int) []uint64 {
+	perturbed := make([]uint64, len(sig))
+	copy(perturbed, sig)
+	for i := 0; i < len(perturbed); i += n {
+		perturbed[i]++
+	}
+	return perturbed
+}
+
+// benchmarkQuerySuite queries an index of numKeys random signatures with
+// signatures similar to indexed ones.
+func benchmarkQuerySuite(threshold float64, numHash, numKeys int, b *testing.B) {
+	f := NewMinhashLSH16(numHash, threshold, numKeys)
+	sigs := make([][]uint64, numKeys)
+	for i := range sigs {
+		sigs[i] = randomSignature(numHash, int64(i))
+		f.Add(i, sigs[i])
+	}
+	f.Index()
+	// Queries similar to indexed signatures.
+	queries := make([][]uint64, 100)
+	for i := range queries {
+		queries[i] = perturbSignature(sigs[i*numKeys/len(queries)], 10)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Query(queries[n%len(queries)])
+	}
+}
+
+func Benchmark_QueryThreshold05_NumHash64_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.5, 64, 1000, b)
+}
+
+func Benchmark_QueryThreshold05_NumHash64_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.5, 64, 10000, b)
+}
+
+func Benchmark_QueryThreshold05_NumHash128_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.5, 128, 1000, b)
+}
+
+func Benchmark_QueryThreshold05_NumHash128_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.5, 128, 10000, b)
+}
+
+func Benchmark_QueryThreshold05_NumHash256_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.5, 256, 1000, b)
+}
+
+func Benchmark_QueryThreshold05_NumHash256_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.5, 256, 10000, b)
+}
+
+func Benchmark_QueryThreshold07_NumHash64_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.7, 64, 1000, b)
+}
+
+func Benchmark_QueryThreshold07_NumHash64_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.7, 64, 10000, b)
+}
+
+func Benchmark_QueryThreshold07_NumHash128_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.7, 128, 1000, b)
+}
+
+func Benchmark_QueryThreshold07_NumHash128_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.7, 128, 10000, b)
+}
+
+func Benchmark_QueryThreshold07_NumHash256_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.7, 256, 1000, b)
+}
+
+func Benchmark_QueryThreshold07_NumHash256_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.7, 256, 10000, b)
+}
+
+func Benchmark_QueryThreshold09_NumHash64_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.9, 64, 1000, b)
+}
+
+func Benchmark_QueryThreshold09_NumHash64_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.9, 64, 10000, b)
+}
+
+func Benchmark_QueryThreshold09_NumHash128_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.9, 128, 1000, b)
+}
+
+func Benchmark_QueryThreshold09_NumHash128_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.9, 128, 10000, b)
+}
+
+func Benchmark_QueryThreshold09_NumHash256_Keys1000(b *testing.B) {
+	benchmarkQuerySuite(0.9, 256, 1000, b)
+}
+
+func Benchmark_QueryThreshold09_NumHash256_Keys10000(b *testing.B) {
+	benchmarkQuerySuite(0.9, 256, 10000, b)
+}
+
+func benchmarkQueryBatchIndex() (*MinhashLSH, [][]uint64) {
+	numKeys := 10000
+	f := NewMinhashLSH16(64, 0.5, numKeys)
+	for i := 0; i < numKeys; i++ {
+		f.Add(i, randomSignature(64, int64(i/10)))
+	}
+	f.Index()
+	queries := make([][]uint64, 1000)
+	for i := range queries {
+		queries[i] = randomSignature(64, int64(i))
+	}
+	return f, queries
+}
+
+func Benchmark_QuerySerial1000(b *testing.B) {
+	f, queries := benchmarkQueryBatchIndex()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, sig := range queries {
+			f.Query(sig)
+		}
+	}
+}
+
+func Benchmark_QueryBatch1000(b *testing.B) {
+	f, queries := benchmarkQueryBatchIndex()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.QueryBatch(queries)
+	}
+}
+
+// benchmarkBandKeysData returns 10000 random signatures of numHash
+// 64-bit hash values.
+func benchmarkBandKeysData(numHash int) [][]uint64 {
+	sigs := make([][]uint64, 10000)
+	for i := range sigs {
+		sigs[i] = randomSignature(numHash, int64(i))
+	}
+	return sigs
+}
+
+// benchmarkBandKeysAddIndex builds an index of 10000 keys with the
+// options, to compare concatenated and hashed band keys.
+func benchmarkBandKeysAddIndex(numHash int, opts []Option, b *testing.B) {
+	sigs := benchmarkBandKeysData(numHash)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f := NewMinhashLSH64(numHash, 0.9, len(sigs), opts...)
+		for i := range sigs {
+			f.Add(i, sigs[i])
+		}
+		f.Index()
+	}
+}
+
+// benchmarkBandKeysQuery queries an index of 10000 keys built with the
+// options, to compare concatenated and hashed band keys.
+func benchmarkBandKeysQuery(numHash int, opts []Option, b *testing.B) {
+	sigs := benchmarkBandKeysData(numHash)
+	f := NewMinhashLSH64(numHash, 0.9, len(sigs), opts...)
+	for i := range sigs {
+		f.Add(i, sigs[i])
+	}
+	f.Index()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Query(sigs[n%len(sigs)])
+	}
+}
+
+func Benchmark_BandKeysConcatAddIndex64(b *testing.B) {
+	benchmarkBandKeysAddIndex(64, nil, b)
+}
+
+func Benchmark_BandKeysFNVAddIndex64(b *testing.B) {
+	benchmarkBandKeysAddIndex(64, []Option{HashedBandKeys()}, b)
+}
+
+func Benchmark_BandKeysConcatAddIndex256(b *testing.B) {
+	benchmarkBandKeysAddIndex(256, nil, b)
+}
+
+func Benchmark_BandKeysFNVAddIndex256(b *testing.B) {
+	benchmarkBandKeysAddIndex(256, []Option{HashedBandKeys()}, b)
+}
+
+func Benchmark_BandKeysConcatQuery64(b *testing.B) {
+	benchmarkBandKeysQuery(64, nil, b)
+}
+
+func Benchmark_BandKeysFNVQuery64(b *testing.B) {
+	benchmarkBandKeysQuery(64, []Option{HashedBandKeys()}, b)
+}
+
+func Benchmark_BandKeysConcatQuery256(b *testing.B) {
+	benchmarkBandKeysQuery(256, nil, b)
+}
+
+func Benchmark_BandKeysFNVQuery256(b *testing.B) {
+	benchmarkBandKeysQuery(256, []Option{HashedBandKeys()}, b)
+}
+
+func Benchmark_Merge1024(b *testing.B) {
+	ms := make([]*Minhash, 100)
+	for i := range ms {
+		ms[i] = NewMinhash(1, 1024)
+		ms[i].Push([]byte(strconv.Itoa(i)))
+	}
+	union := NewMinhash(1, 1024)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		union.Merge(ms[n%len(ms)])
+	}
+}
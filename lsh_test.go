@@ -1,7 +1,15 @@
 package minhashlsh
 
 import (
+	"bytes"
+	"log"
+	"math"
 	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -98,3 +106,1440 @@ func Test_MinhashLSH2(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_MinhashLSHQueryDetailed(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3, StoreSignatures())
+	sig1 := randomSignature(256, 1)
+	sig2 := randomSignature(256, 2)
+	f.Add("sig1", sig1)
+	f.Add("sig2", sig2)
+	f.Index()
+
+	_, l := f.Params()
+	results := f.QueryDetailed(sig2)
+	if len(results) != 1 {
+		t.Fatal(results)
+	}
+	r := results[0]
+	if r.Key.(string) != "sig2" {
+		t.Fatal(r.Key)
+	}
+	if r.BandMatches != l {
+		t.Fatalf("expected %d band matches, got %d", l, r.BandMatches)
+	}
+	if r.Similarity != 1.0 {
+		t.Fatal(r.Similarity)
+	}
+
+	// Without stored signatures the similarity is not available.
+	f = NewMinhashLSH16(256, 0.6, 3)
+	f.Add("sig2", sig2)
+	f.Index()
+	results = f.QueryDetailed(sig2)
+	if len(results) != 1 || results[0].Similarity != 0 {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHRates(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 0)
+	k, l := f.Params()
+	for _, s := range []float64{0.0, 0.3, 0.6, 0.9, 1.0} {
+		p := 1.0 - math.Pow(1.0-math.Pow(s, float64(k)), float64(l))
+		if math.Abs(f.FalsePositiveRate(s)-p) > 1e-12 {
+			t.Errorf("false positive rate at %.1f: expected %f, got %f", s, p, f.FalsePositiveRate(s))
+		}
+		if math.Abs(f.FalseNegativeRate(s)-(1.0-p)) > 1e-12 {
+			t.Errorf("false negative rate at %.1f: expected %f, got %f", s, 1.0-p, f.FalseNegativeRate(s))
+		}
+	}
+	if f.ExpectedRecallAtThreshold() != f.FalsePositiveRate(0.6) {
+		t.Error("expected recall at threshold should be the candidate probability at 0.6")
+	}
+	if f.FalsePositiveRate(0.3) >= f.FalsePositiveRate(0.9) {
+		t.Error("false positive rate should increase with similarity")
+	}
+}
+
+func Test_MinhashLSHConcurrentAdd(t *testing.T) {
+	numKeys := 1000
+	sigs := make([][]uint64, numKeys)
+	for i := range sigs {
+		// Every 10 keys share a signature so buckets have multiple keys.
+		sigs[i] = randomSignature(64, int64(i/10))
+	}
+	serial := NewMinhashLSH16(64, 0.5, numKeys)
+	for i := range sigs {
+		serial.Add(strconv.Itoa(i), sigs[i])
+	}
+	serial.Index()
+
+	concurrent := NewMinhashLSH16(64, 0.5, 0, StoreSignatures())
+	var wg sync.WaitGroup
+	numWorkers := 16
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < numKeys; i += numWorkers {
+				concurrent.Add(strconv.Itoa(i), sigs[i])
+			}
+		}(w)
+	}
+	wg.Wait()
+	concurrent.Index()
+
+	for i := range concurrent.hashTables {
+		if len(concurrent.hashTables[i]) != numKeys {
+			t.Fatalf("band %d has %d entries", i, len(concurrent.hashTables[i]))
+		}
+	}
+	if len(concurrent.signatures) != numKeys {
+		t.Fatalf("%d signatures stored", len(concurrent.signatures))
+	}
+	for i := range sigs {
+		expected := make(map[interface{}]bool)
+		for _, key := range serial.Query(sigs[i]) {
+			expected[key] = true
+		}
+		results := concurrent.Query(sigs[i])
+		if len(results) != len(expected) {
+			t.Fatalf("query %d: expected %d results, got %d", i, len(expected), len(results))
+		}
+		for _, key := range results {
+			if !expected[key] {
+				t.Fatalf("query %d: unexpected result %v", i, key)
+			}
+		}
+	}
+}
+
+func Test_MinhashLSHExportBands(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3)
+	f.Add("sig1", randomSignature(256, 1))
+	f.Add("sig2", randomSignature(256, 2))
+	f.Add("sig3", randomSignature(256, 2))
+	f.Index()
+	// Not indexed yet, should not be exported.
+	f.Add("sig4", randomSignature(256, 4))
+
+	_, l := f.Params()
+	bands := f.ExportBands()
+	if len(bands) != l {
+		t.Fatalf("expected %d bands, got %d", l, len(bands))
+	}
+	for _, band := range bands {
+		if len(band) != 2 {
+			t.Fatalf("expected 2 buckets, got %d", len(band))
+		}
+		var numKeys int
+		for hashKey, keys := range band {
+			numKeys += len(keys)
+			// Mutating the copy should not change the index.
+			band[hashKey] = nil
+		}
+		if numKeys != 3 {
+			t.Fatalf("expected 3 keys, got %d", numKeys)
+		}
+	}
+	if len(f.Query(randomSignature(256, 2))) != 2 {
+		t.Fatal("index modified through exported bands")
+	}
+}
+
+func Test_MinhashLSHQueryExcluding(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3)
+	sig := randomSignature(256, 2)
+	f.Add("sig1", randomSignature(256, 1))
+	f.Add("sig2", sig)
+	f.Add("sig3", sig)
+	f.Index()
+
+	results := f.QueryExcluding(sig, "sig2")
+	if len(results) != 1 || results[0].(string) != "sig3" {
+		t.Fatal(results)
+	}
+	if len(f.QueryExcluding(sig, "sig4")) != 2 {
+		t.Fatal("excluding a key not in the index should not affect results")
+	}
+}
+
+func Test_MinhashLSHQueryFilter(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3)
+	sig := randomSignature(256, 2)
+	f.Add("a/sig1", sig)
+	f.Add("b/sig2", sig)
+	f.Add("a/sig3", randomSignature(256, 1))
+	f.Index()
+
+	results := f.QueryFilter(sig, func(key interface{}) bool {
+		return strings.HasPrefix(key.(string), "a/")
+	})
+	if len(results) != 1 || results[0].(string) != "a/sig1" {
+		t.Fatal(results)
+	}
+	if len(f.QueryFilter(sig, nil)) != 2 {
+		t.Fatal("nil keep should return all candidates")
+	}
+}
+
+func Test_MinhashLSHQueryExcludingFunc(t *testing.T) {
+	type doc struct {
+		ID      string
+		Version int
+	}
+	f := NewMinhashLSH16(256, 0.6, 2)
+	sig := randomSignature(256, 2)
+	f.Add(doc{"a", 1}, sig)
+	f.Add(doc{"b", 1}, sig)
+	f.Index()
+
+	// Documents with the same ID are the same regardless of version.
+	sameID := func(a, b interface{}) bool {
+		return a.(doc).ID == b.(doc).ID
+	}
+	results := f.QueryExcludingFunc(sig, doc{"a", 2}, sameID)
+	if len(results) != 1 || results[0].(doc).ID != "b" {
+		t.Fatal(results)
+	}
+	if len(f.QueryExcludingFunc(sig, doc{"a", 2}, nil)) != 2 {
+		t.Fatal("nil equal should compare keys with ==")
+	}
+}
+
+func Test_MinhashLSHBuildSorted(t *testing.T) {
+	numKeys := 100
+	keys := make([]interface{}, numKeys)
+	sigs := make([][]uint64, numKeys)
+	for i := range sigs {
+		keys[i] = strconv.Itoa(i)
+		sigs[i] = randomSignature(64, int64(i/4))
+	}
+	serial := NewMinhashLSH16(64, 0.5, numKeys)
+	for i := range sigs {
+		serial.Add(keys[i], sigs[i])
+	}
+	serial.Index()
+
+	f := NewMinhashLSH16(64, 0.5, numKeys)
+	// Build in two batches to exercise merging into an existing index.
+	if err := f.BuildSorted(keys[:50], sigs[:50]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.BuildSorted(keys[50:], sigs[50:]); err != nil {
+		t.Fatal(err)
+	}
+	for i := range f.hashTables {
+		if !sort.IsSorted(f.hashTables[i]) {
+			t.Fatalf("band %d is not sorted", i)
+		}
+	}
+	for i := range sigs {
+		if len(f.Query(sigs[i])) != len(serial.Query(sigs[i])) {
+			t.Fatalf("query %d: results differ from serial build", i)
+		}
+	}
+	if err := f.BuildSorted(keys[:1], sigs); err == nil {
+		t.Fatal("expected error for mismatched keys and signatures")
+	}
+}
+
+func Test_MinhashLSHCardinalityStats(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2, StoreSignatures())
+	if min, max, mean := f.CardinalityStats(); min != 0 || max != 0 || mean != 0 {
+		t.Fatal("empty index should have zero cardinality stats")
+	}
+	for i, size := range []int{100, 1000} {
+		mh := NewMinhash(1, 256)
+		for j := 0; j < size; j++ {
+			mh.Push([]byte(strconv.Itoa(j)))
+		}
+		f.Add(i, mh.Signature())
+	}
+	min, max, mean := f.CardinalityStats()
+	t.Logf("min = %f, max = %f, mean = %f", min, max, mean)
+	if min <= 0 || min >= max {
+		t.Fatalf("the larger set should have the larger estimate: min = %f, max = %f", min, max)
+	}
+	if mean != (min+max)/2 {
+		t.Fatal(mean)
+	}
+}
+
+func Test_MinhashLSHSkipEmptySignatures(t *testing.T) {
+	empty := NewMinhash(1, 256).Signature()
+	f := NewMinhashLSH16(256, 0.6, 3)
+	f.Add("empty1", empty)
+	f.Add("empty2", empty)
+	f.Index()
+	if len(f.Query(empty)) != 2 {
+		t.Fatal("empty signatures should collide without SkipEmptySignatures")
+	}
+
+	f = NewMinhashLSH16(256, 0.6, 3, SkipEmptySignatures())
+	f.Add("empty1", empty)
+	f.Add("empty2", empty)
+	f.Add("sig1", randomSignature(256, 1))
+	f.Index()
+	if f.numIndexedKeys != 1 {
+		t.Fatalf("expected 1 indexed key, got %d", f.numIndexedKeys)
+	}
+	if len(f.Query(empty)) != 0 {
+		t.Fatal("query with an empty signature should return no candidates")
+	}
+	if len(f.Query(randomSignature(256, 1))) != 1 {
+		t.Fatal("unable to retrieve inserted key")
+	}
+}
+
+func Test_MinhashLSHQueryMinhash(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 1)
+	mh := NewMinhash(1, 256)
+	for _, v := range data(10) {
+		mh.Push(v)
+	}
+	f.Add("s1", mh.Signature())
+	f.Index()
+	if results := f.QueryMinhash(mh); len(results) != 1 {
+		t.Fatal(results)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for Minhash of different size")
+		}
+	}()
+	f.QueryMinhash(NewMinhash(1, 128))
+}
+
+func Test_MinhashLSHQueryMinhashSeed(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 1, SignatureSeed(1))
+	mh := NewMinhash(1, 256)
+	for _, v := range data(10) {
+		mh.Push(v)
+	}
+	f.Add("s1", mh.Signature())
+	f.Index()
+	if results := f.QueryMinhash(mh); len(results) != 1 {
+		t.Fatal(results)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for Minhash of different seed")
+		}
+	}()
+	f.QueryMinhash(NewMinhash(2, 256))
+}
+
+func Test_MinhashLSHAutoIndex(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2, AutoIndex())
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	if len(f.Query(sig)) != 1 {
+		t.Fatal("added key should be searchable without calling Index()")
+	}
+	f.Add("sig2", sig)
+	if len(f.Query(sig)) != 2 {
+		t.Fatal("key added after a query should be searchable")
+	}
+}
+
+func Test_MinhashLSHDuplicateKeys(t *testing.T) {
+	sig1 := randomSignature(256, 1)
+	sig2 := randomSignature(256, 2)
+
+	// By default duplicate keys are kept with both signatures.
+	f := NewMinhashLSH16(256, 0.6, 2)
+	f.Add("key", sig1)
+	f.Index()
+	if err := f.Add("key", sig2); err != nil {
+		t.Fatal(err)
+	}
+	f.Index()
+	if len(f.Query(sig1)) != 1 || len(f.Query(sig2)) != 1 {
+		t.Fatal("key should be found with both signatures")
+	}
+
+	f = NewMinhashLSH16(256, 0.6, 2, DuplicateKeys(ReplaceDuplicateKeys))
+	f.Add("key", sig1)
+	f.Add("other", sig1)
+	f.Index()
+	if err := f.Add("key", sig2); err != nil {
+		t.Fatal(err)
+	}
+	// The previous entries are removed even before indexing.
+	if results := f.Query(sig1); len(results) != 1 || results[0] != "other" {
+		t.Fatal(results)
+	}
+	f.Index()
+	if results := f.Query(sig2); len(results) != 1 || results[0] != "key" {
+		t.Fatal(results)
+	}
+	for i := range f.hashTables {
+		if len(f.hashTables[i]) != 2 {
+			t.Fatal("stale entries left in hash tables")
+		}
+	}
+
+	f = NewMinhashLSH16(256, 0.6, 2, DuplicateKeys(RejectDuplicateKeys))
+	f.Add("key", sig1)
+	if err := f.Add("key", sig2); err != ErrDuplicateKey {
+		t.Fatal("expected ErrDuplicateKey")
+	}
+	f.Index()
+	if len(f.Query(sig2)) != 0 {
+		t.Fatal("rejected signature should not be indexed")
+	}
+	if err := f.BuildSorted([]interface{}{"new", "key"}, [][]uint64{sig2, sig2}); err != ErrDuplicateKey {
+		t.Fatal("expected ErrDuplicateKey from BuildSorted")
+	}
+}
+
+func Test_MinhashLSHQueryWithStats(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3)
+	sig := randomSignature(256, 2)
+	f.Add("sig1", randomSignature(256, 1))
+	f.Add("sig2", sig)
+	f.Add("sig3", sig)
+	f.Index()
+
+	_, l := f.Params()
+	results, stats := f.QueryWithStats(sig)
+	if len(results) != 2 || stats.Candidates != 2 {
+		t.Fatal(results, stats)
+	}
+	if stats.EntriesScanned != 2*l {
+		t.Fatalf("expected %d entries scanned, got %d", 2*l, stats.EntriesScanned)
+	}
+}
+
+func Test_MinhashLSHQueryLimit(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 10)
+	sig := randomSignature(256, 1)
+	for i := 0; i < 10; i++ {
+		f.Add(i, sig)
+	}
+	f.Index()
+	if results := f.QueryLimit(sig, 3); len(results) != 3 {
+		t.Fatal(results)
+	}
+	if results := f.QueryLimit(sig, 20); len(results) != 10 {
+		t.Fatal(results)
+	}
+	if results := f.QueryLimit(sig, 0); len(results) != 0 {
+		t.Fatal(results)
+	}
+	if count := f.QueryCount(sig); count != 10 {
+		t.Fatal(count)
+	}
+	if count := f.QueryCount(randomSignature(256, 2)); count != 0 {
+		t.Fatal(count)
+	}
+}
+
+func Test_MinhashLSHQueryCount(t *testing.T) {
+	for _, policy := range []DuplicateKeyPolicy{AllowDuplicateKeys, ReplaceDuplicateKeys} {
+		f := NewMinhashLSH16(256, 0.6, 10, DuplicateKeys(policy))
+		k, l := f.Params()
+		if l < 2 {
+			t.Fatalf("expected more than one band, got %d", l)
+		}
+		sig := randomSignature(256, 1)
+		for i := 0; i < 10; i++ {
+			f.Add(i, sig)
+		}
+		// Added twice, but counted once.
+		f.Add(0, sig)
+		f.Index()
+		if count := f.QueryCount(sig); count != 10 {
+			t.Fatal(policy, count)
+		}
+		// Collides with the keys in the first band only.
+		first := randomSignature(256, 2)
+		copy(first, sig[:k])
+		if count := f.QueryCount(first); count != 10 {
+			t.Fatal(policy, count)
+		}
+	}
+}
+
+func Test_MinhashLSHRehashKeyWidth(t *testing.T) {
+	sigs := make([][]uint64, 20)
+	f := NewMinhashLSH64(256, 0.6, len(sigs), StoreSignatures())
+	g := NewMinhashLSH16(256, 0.6, len(sigs))
+	for i := range sigs {
+		sigs[i] = randomSignature(256, int64(i/2))
+		f.Add(i, sigs[i])
+		g.Add(i, sigs[i])
+	}
+	f.Index()
+	g.Index()
+
+	check := func(width int) {
+		for i := range f.hashTables {
+			for j := range f.hashTables[i] {
+				if f.hashTables[i][j].hashKey != g.hashTables[i][j].hashKey {
+					t.Fatalf("width %d: hash keys differ from an index built with the width", width)
+				}
+			}
+		}
+		for i := range sigs {
+			if len(f.Query(sigs[i])) != 2 {
+				t.Fatalf("width %d: unable to retrieve keys", width)
+			}
+		}
+	}
+	// Narrowing from 64 to 16 bits.
+	if err := f.RehashKeyWidth(2); err != nil {
+		t.Fatal(err)
+	}
+	check(2)
+	// Widening back to 64 bits uses the stored signatures.
+	if err := f.RehashKeyWidth(8); err != nil {
+		t.Fatal(err)
+	}
+	g = NewMinhashLSH64(256, 0.6, len(sigs))
+	for i := range sigs {
+		g.Add(i, sigs[i])
+	}
+	g.Index()
+	check(8)
+
+	if err := NewMinhashLSH16(256, 0.6, 0).RehashKeyWidth(8); err == nil {
+		t.Fatal("expected error for widening without stored signatures")
+	}
+	if err := f.RehashKeyWidth(9); err == nil {
+		t.Fatal("expected error for unsupported width")
+	}
+}
+
+func Test_MinhashLSHBucketMates(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3)
+	sig := randomSignature(256, 2)
+	f.Add("sig1", randomSignature(256, 1))
+	f.Add("sig2", sig)
+	f.Add("sig3", sig)
+	f.Index()
+
+	if mates := f.BucketMates("sig2"); len(mates) != 1 || mates[0] != "sig3" {
+		t.Fatal(mates)
+	}
+	if mates := f.BucketMates("sig1"); len(mates) != 0 {
+		t.Fatal(mates)
+	}
+	if mates := f.BucketMates("sig4"); len(mates) != 0 {
+		t.Fatal(mates)
+	}
+}
+
+func Test_MinhashLSHDegenerateParams(t *testing.T) {
+	f := NewMinhashLSH16(8, 0.99, 1)
+	k, l := f.Params()
+	if k < 1 || l < 1 || k*l > 8 {
+		t.Fatalf("degenerate parameters k = %d, l = %d", k, l)
+	}
+	sig := randomSignature(8, 1)
+	f.Add("sig", sig)
+	f.Index()
+	if results := f.Query(sig); len(results) != 1 {
+		t.Fatal(results)
+	}
+
+	var buf bytes.Buffer
+	f = NewMinhashLSH16(0, 0.99, 1, Logger(log.New(&buf, "", 0)))
+	if k, l := f.Params(); k != 1 || l != 1 {
+		t.Fatalf("expected fallback k = 1, l = 1, got k = %d, l = %d", k, l)
+	}
+	if !strings.Contains(buf.String(), "falling back to k = 1, l = 1") {
+		t.Fatalf("expected a warning for the fallback, got %q", buf.String())
+	}
+	buf.Reset()
+	NewMinhashLSH16(8, 0.99, 1, Logger(log.New(&buf, "", 0)))
+	if buf.Len() != 0 {
+		t.Fatalf("expected no warning, got %q", buf.String())
+	}
+	// Without a logger nothing is logged, even to the standard logger.
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	NewMinhashLSH16(0, 0.99, 1, WarnCrowdedBuckets(log.New(&buf, "", 0)))
+	if buf.Len() != 0 {
+		t.Fatalf("expected no warning without Logger, got %q", buf.String())
+	}
+}
+
+func Test_MinhashLSHQueryPrefix(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2)
+	k, l := f.Params()
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	// Differs from sig only in the first band.
+	sig2 := make([]uint64, len(sig))
+	copy(sig2, sig)
+	sig2[0]++
+	f.Add("sig2", sig2)
+	f.Index()
+
+	if results := f.QueryPrefix(sig[:k], 1); len(results) != 1 || results[0] != "sig1" {
+		t.Fatal(results)
+	}
+	if results := f.QueryPrefix(sig, l); len(results) != 2 {
+		t.Fatal(results)
+	}
+	if results := f.QueryPrefix(sig, 0); len(results) != 0 {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHAddWithValue(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3, SkipEmptySignatures())
+	sig := randomSignature(256, 1)
+	f.AddWithValue("sig1", sig, "http://example.com/1")
+	f.Add("sig2", sig)
+	empty := make([]uint64, 256)
+	for i := range empty {
+		empty[i] = math.MaxUint64
+	}
+	f.AddWithValue("sig3", empty, "http://example.com/3")
+	f.Index()
+
+	results := f.QueryValues(sig)
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	for _, r := range results {
+		switch r.Key {
+		case "sig1":
+			if r.Value != "http://example.com/1" {
+				t.Fatal(r)
+			}
+		case "sig2":
+			if r.Value != nil {
+				t.Fatal(r)
+			}
+		default:
+			t.Fatal(r)
+		}
+	}
+	if _, exist := f.values["sig3"]; exist {
+		t.Fatal("value of a skipped key should not be stored")
+	}
+}
+
+func Test_MinhashLSHRecomputeSignatures(t *testing.T) {
+	d := data(100)
+	sets := [][][]byte{d[:50], d[:49], d[50:]}
+	f := NewMinhashLSH16(64, 0.8, 3, RetainElements())
+	for i, sig := range Signatures(sets, 1, 64, 1) {
+		if err := f.AddWithElements(i, sig, sets[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Index()
+
+	if err := f.RecomputeSignatures(2, 128); err != nil {
+		t.Fatal(err)
+	}
+	if f.numHash != 128 {
+		t.Fatal(f.numHash)
+	}
+	if k, l := f.Params(); k*l > 128 || k*l <= 64 {
+		t.Fatalf("expected parameters for 128 hash functions, got k = %d, l = %d", k, l)
+	}
+	sig := Signatures(sets[:1], 2, 128, 1)[0]
+	results := f.Query(sig)
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	for _, key := range results {
+		if key != 0 && key != 1 {
+			t.Fatal(results)
+		}
+	}
+
+	f.Add(3, sig)
+	if err := f.RecomputeSignatures(2, 128); err == nil {
+		t.Fatal("expected error for a key without retained elements")
+	}
+	g := NewMinhashLSH16(64, 0.8, 1)
+	if err := g.RecomputeSignatures(2, 128); err == nil {
+		t.Fatal("expected error without RetainElements")
+	}
+}
+
+func Test_MinhashLSHRemove(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3, StoreSignatures())
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	f.Add("sig2", sig)
+	f.Index()
+	f.Add("sig3", sig)
+
+	if !f.Remove("sig1") || !f.Remove("sig3") {
+		t.Fatal("expected keys to be removed")
+	}
+	if f.Remove("sig4") {
+		t.Fatal("expected false for a key not in the index")
+	}
+	f.Index()
+	results := f.Query(sig)
+	if len(results) != 1 || results[0] != "sig2" {
+		t.Fatal(results)
+	}
+	if _, exist := f.signatures["sig1"]; exist {
+		t.Fatal("signature of a removed key should be deleted")
+	}
+}
+
+func Test_MinhashLSHBounded(t *testing.T) {
+	f := NewMinhashLSHBounded(256, 0.6, 2)
+	sigs := make([][]uint64, 4)
+	for i := range sigs {
+		sigs[i] = randomSignature(256, int64(i))
+	}
+	f.Add(0, sigs[0])
+	f.Add(1, sigs[1])
+	f.Index()
+	// Querying key 0 makes key 1 the least recently used.
+	if results := f.Query(sigs[0]); len(results) != 1 {
+		t.Fatal(results)
+	}
+	f.Add(2, sigs[2])
+	f.Index()
+	if results := f.Query(sigs[1]); len(results) != 0 {
+		t.Fatal("expected key 1 to be evicted", results)
+	}
+	if len(f.members) != 2 {
+		t.Fatal(len(f.members))
+	}
+	for _, key := range []int{0, 2} {
+		if results := f.Query(sigs[key]); len(results) != 1 || results[0] != key {
+			t.Fatal(results)
+		}
+	}
+	if err := f.BuildSorted([]interface{}{3}, sigs[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if results := f.Query(sigs[0]); len(results) != 0 {
+		t.Fatal("expected key 0 to be evicted", results)
+	}
+	for i := range f.hashTables {
+		if len(f.hashTables[i]) != 2 {
+			t.Fatal("evicted keys should be removed from all bands")
+		}
+	}
+}
+
+func Test_MinhashLSHQueryByBand(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2)
+	_, l := f.Params()
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	// Differs from sig only in the first band.
+	sig2 := make([]uint64, len(sig))
+	copy(sig2, sig)
+	sig2[0]++
+	f.Add("sig2", sig2)
+	f.Index()
+
+	bands := f.QueryByBand(sig)
+	if len(bands) != l {
+		t.Fatalf("expected %d bands, got %d", l, len(bands))
+	}
+	if len(bands[0]) != 1 || bands[0][0] != "sig1" {
+		t.Fatal(bands[0])
+	}
+	for i := 1; i < l; i++ {
+		if len(bands[i]) != 2 {
+			t.Fatal(bands[i])
+		}
+	}
+}
+
+func Test_MinhashLSHCompact(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 100, StoreSignatures())
+	sig := randomSignature(256, 1)
+	for i := 0; i < 100; i++ {
+		f.Add(i, randomSignature(256, int64(i+2)))
+	}
+	f.Add("sig", sig)
+	f.Index()
+	for i := 0; i < 100; i++ {
+		f.Remove(i)
+	}
+	f.Add("pending", sig)
+	f.Compact()
+
+	for _, table := range f.hashTables {
+		if cap(table) != len(table) || len(table) != 2 {
+			t.Fatal("expected hash tables to be shrunk to fit")
+		}
+	}
+	if len(f.members) != 2 || len(f.signatures) != 2 {
+		t.Fatal("expected only remaining keys")
+	}
+	if results := f.Query(sig); len(results) != 1 || results[0] != "sig" {
+		t.Fatal(results)
+	}
+	f.Index()
+	if results := f.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+}
+
+type halfEstimator struct{}
+
+func (halfEstimator) Estimate(matches, numHash int) float64 {
+	return float64(matches) / float64(2*numHash)
+}
+
+func Test_MinhashLSHEstimator(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 1, StoreSignatures(), Estimator(halfEstimator{}))
+	sig := randomSignature(256, 1)
+	f.Add("sig", sig)
+	f.Index()
+	results := f.QueryDetailed(sig)
+	if len(results) != 1 || results[0].Similarity != 0.5 {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHQueryWithSizes(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2)
+	sig := randomSignature(256, 1)
+	f.AddWithSize("sig1", sig, 10)
+	f.Add("sig2", sig)
+	f.Index()
+
+	results := f.QueryWithSizes(sig)
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	for _, r := range results {
+		if (r.Key == "sig1" && r.Size != 10) || (r.Key == "sig2" && r.Size != -1) {
+			t.Fatal(r)
+		}
+	}
+}
+
+func Test_MinhashLSHWarnCrowdedBuckets(t *testing.T) {
+	var buf bytes.Buffer
+	f := NewMinhashLSH16(256, 0.6, 20, WarnCrowdedBuckets(log.New(&buf, "", 0)))
+	for i := 0; i < 20; i++ {
+		f.Add(i, randomSignature(256, int64(i)))
+	}
+	f.Index()
+	if buf.Len() != 0 {
+		t.Fatal(buf.String())
+	}
+	empty := NewMinhash(1, 256).Signature()
+	for i := 20; i < 50; i++ {
+		f.Add(i, empty)
+	}
+	f.Index()
+	if !strings.Contains(buf.String(), "30 of 50 entries share one bucket") ||
+		!strings.Contains(buf.String(), "empty") {
+		t.Fatal(buf.String())
+	}
+}
+
+func Test_MinhashLSHQueryBatch(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 10)
+	sigs := make([][]uint64, 10)
+	for i := range sigs {
+		sigs[i] = randomSignature(256, int64(i))
+		f.Add(i, sigs[i])
+	}
+	f.Index()
+	results := f.QueryBatch(sigs)
+	if len(results) != len(sigs) {
+		t.Fatal(len(results))
+	}
+	for i, result := range results {
+		if len(result) != 1 || result[0] != i {
+			t.Fatal(i, result)
+		}
+	}
+	if len(f.QueryBatch(nil)) != 0 {
+		t.Fatal("expected no results for no queries")
+	}
+}
+
+func Test_MinhashLSHLoadFactor(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 20)
+	if lf := f.LoadFactor(); lf != 0 {
+		t.Fatal(lf)
+	}
+	for i := 0; i < 10; i++ {
+		f.Add(i, randomSignature(256, int64(i)))
+	}
+	f.Index()
+	if lf := f.LoadFactor(); lf != 1 {
+		t.Fatal(lf)
+	}
+	sig := randomSignature(256, 100)
+	for i := 10; i < 20; i++ {
+		f.Add(i, sig)
+	}
+	f.Index()
+	// 20 entries in 11 buckets per band.
+	if lf := f.LoadFactor(); math.Abs(lf-20.0/11) > 1e-9 {
+		t.Fatal(lf)
+	}
+}
+
+func Test_MinhashLSHExpectedCandidatesPerQuery(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 20)
+	_, l := f.Params()
+	if c := f.ExpectedCandidatesPerQuery(); c != 0 {
+		t.Fatal(c)
+	}
+	for i := 0; i < 10; i++ {
+		f.Add(i, randomSignature(256, int64(i)))
+	}
+	f.Index()
+	if c := f.ExpectedCandidatesPerQuery(); c != float64(l) {
+		t.Fatal(c)
+	}
+	sig := randomSignature(256, 100)
+	for i := 10; i < 20; i++ {
+		f.Add(i, sig)
+	}
+	f.Index()
+	// Per band, 10 buckets of 1 entry and one of 10 out of 20 entries.
+	if c := f.ExpectedCandidatesPerQuery(); math.Abs(c-float64(l)*110/20) > 1e-9 {
+		t.Fatal(c)
+	}
+}
+
+func Test_MinhashLSHHashedBandKeys(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 3, HashedBandKeys())
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	f.Add("sig2", sig)
+	f.Add("sig3", randomSignature(256, 2))
+	f.Index()
+	if len(f.hashTables[0][0].hashKey) != 8 {
+		t.Fatal("expected 8-byte hash keys")
+	}
+	if results := f.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RehashKeyWidth(1); err == nil {
+		t.Fatal("expected error for rehashing hashed band keys")
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g MinhashLSH
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHBandSeeds(t *testing.T) {
+	sig := randomSignature(256, 1)
+	// Differs from sig only above the lowest 2 bytes of every hash value,
+	// so it collides with sig in every band of a 16-bit index.
+	crafted := make([]uint64, len(sig))
+	for i, v := range sig {
+		crafted[i] = v + 1<<16
+	}
+	f := NewMinhashLSH16(256, 0.6, 3)
+	f.Add("crafted", crafted)
+	f.Index()
+	if results := f.Query(sig); len(results) != 1 {
+		t.Fatal(results)
+	}
+
+	f = NewMinhashLSH16(256, 0.6, 3, BandSeeds(7), StoreSignatures())
+	f.Add("sig1", sig)
+	f.Add("sig2", sig)
+	f.Add("crafted", crafted)
+	f.Add("sig3", randomSignature(256, 2))
+	f.Index()
+	if f.hashTables[0][0].hashKey == f.hashKeyFunc(f.signatures[f.hashTables[0][0].key][:f.k]) {
+		t.Fatal("expected seeded hash keys")
+	}
+	if results := f.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g MinhashLSH
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+	if err := g.RehashKeyWidth(8); err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHQueryBruteForce(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2, StoreSignatures())
+	k, l := f.Params()
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	// Differs from sig in one hash value of every band.
+	sig2 := make([]uint64, len(sig))
+	copy(sig2, sig)
+	for i := 0; i < l; i++ {
+		sig2[i*k]++
+	}
+	f.Add("sig2", sig2)
+	f.Index()
+
+	if results := f.Query(sig); len(results) != 1 {
+		t.Fatal(results)
+	}
+	results, err := f.QueryBruteForce(sig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	if results, _ := f.QueryBruteForce(sig, 0); len(results) != 1 {
+		t.Fatal(results)
+	}
+	g := NewMinhashLSH16(256, 0.6, 1)
+	if _, err := g.QueryBruteForce(sig, 1); err == nil {
+		t.Fatal("expected error without stored signatures")
+	}
+}
+
+func Test_MinhashLSHSamplePairs(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 10)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 6; i++ {
+		f.Add(i, randomSignature(256, int64(i)))
+	}
+	f.Index()
+	if pairs := f.SamplePairs(10, rng); len(pairs) != 0 {
+		t.Fatal("expected no pairs without shared buckets", pairs)
+	}
+	// Keys 10 and 11 share every bucket, as do 12 and 13.
+	for i := 10; i < 14; i++ {
+		f.Add(i, randomSignature(256, int64(100+i/2)))
+	}
+	f.Index()
+	pairs := f.SamplePairs(20, rng)
+	if len(pairs) != 20 {
+		t.Fatal(len(pairs))
+	}
+	for _, pair := range pairs {
+		x, y := pair[0].(int), pair[1].(int)
+		if x == y || x/2 != y/2 || x < 10 {
+			t.Fatal(pair)
+		}
+	}
+	for _, n := range []int{0, -1} {
+		if pairs := f.SamplePairs(n, rng); pairs != nil {
+			t.Fatalf("expected no pairs for n = %d, got %v", n, pairs)
+		}
+	}
+}
+
+func Test_MinhashLSHQueryTopK(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 20, StoreSignatures())
+	sig := randomSignature(256, 1)
+	// Many candidates tied at the same similarity, and one more similar.
+	near := make([]uint64, len(sig))
+	copy(near, sig)
+	near[0]++
+	keys := []interface{}{"b", 3, "a", 1, 2.5, "c", 2, 1.5}
+	for _, key := range keys {
+		f.Add(key, near)
+	}
+	f.Add("top", sig)
+	f.Index()
+
+	expected := []interface{}{"top", 1, 2, 3, "a", "b", "c", 1.5, 2.5}
+	for run := 0; run < 10; run++ {
+		results := f.QueryTopK(sig, 20)
+		if len(results) != len(expected) {
+			t.Fatal(results)
+		}
+		for i, r := range results {
+			if r.Key != expected[i] {
+				t.Fatalf("expected %v at %d, got %v", expected[i], i, results)
+			}
+		}
+	}
+	if results := f.QueryTopK(sig, 2); len(results) != 2 || results[1].Key != 1 {
+		t.Fatal(results)
+	}
+	if results := f.QueryTopK(sig, 0); len(results) != 0 {
+		t.Fatal(results)
+	}
+}
+
+func Test_FindCrossMatches(t *testing.T) {
+	a := NewMinhashLSH16(256, 0.6, 3, StoreSignatures())
+	b := NewMinhashLSH16(256, 0.6, 3)
+	sig1, sig2 := randomSignature(256, 1), randomSignature(256, 2)
+	a.Add("a1", sig1)
+	a.Add("a2", sig2)
+	a.Add("a3", randomSignature(256, 3))
+	b.Add("b1", sig1)
+	b.Add("b2", sig1)
+	b.Add("b3", sig2)
+	b.Add("b4", randomSignature(256, 4))
+	a.Index()
+	b.Index()
+
+	matches := FindCrossMatches(a, b)
+	if len(matches) != 2 || len(matches["a1"]) != 2 || len(matches["a2"]) != 1 || matches["a2"][0] != "b3" {
+		t.Fatal(matches)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic without stored signatures")
+			}
+		}()
+		FindCrossMatches(b, a)
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for different parameters")
+			}
+		}()
+		FindCrossMatches(a, NewMinhashLSH16(128, 0.6, 0))
+	}()
+}
+
+func Test_MinhashLSHQuerySet(t *testing.T) {
+	elements := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	m := NewMinhash(7, 128)
+	for _, e := range elements {
+		m.Push(e)
+	}
+	f := NewMinhashLSH16(128, 0.8, 2, SignatureSeed(7), BandSeeds(1))
+	f.Add("abcd", m.Signature())
+	f.Add("other", randomSignature(128, 1))
+	f.Index()
+	if results := f.QuerySet(elements); len(results) != 1 || results[0] != "abcd" {
+		t.Fatal(results)
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g MinhashLSH
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if results := g.QuerySet(elements); len(results) != 1 {
+		t.Fatal("signature seed not preserved", results)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic without signature seed")
+		}
+	}()
+	NewMinhashLSH16(128, 0.8, 0).QuerySet(elements)
+}
+
+func Test_MinhashLSHQueryAdaptive(t *testing.T) {
+	for _, opts := range [][]Option{{StoreSignatures()}, {}, {BandSeeds(3)}} {
+		f := NewMinhashLSH16(256, 0.8, 0, opts...)
+		k, l := f.Params()
+		if k < 3 {
+			t.Fatalf("expected k of at least 3, got %d", k)
+		}
+		sig := randomSignature(256, 1)
+		f.Add("same", sig)
+		// Matches the first d hash values of every band of sig.
+		for d := 1; d < k; d++ {
+			near := make([]uint64, len(sig))
+			copy(near, sig)
+			for i := 0; i < l; i++ {
+				for j := i*k + d; j < (i+1)*k; j++ {
+					near[j]++
+				}
+			}
+			f.Add("p"+strconv.Itoa(d), near)
+		}
+		f.Add("far", randomSignature(256, 2))
+		f.Index()
+
+		if results := f.QueryAdaptive(sig, 1); len(results) != 1 || results[0] != "same" {
+			t.Fatal(results)
+		}
+		expected := []interface{}{"same", "p" + strconv.Itoa(k-1), "p" + strconv.Itoa(k-2)}
+		results := f.QueryAdaptive(sig, 3)
+		if len(results) != 3 {
+			t.Fatal(results)
+		}
+		for i := range expected {
+			if results[i] != expected[i] {
+				t.Fatalf("expected %v, got %v", expected, results)
+			}
+		}
+		// Under-shoots, as far does not share the first value of a band.
+		if results := f.QueryAdaptive(sig, 100); len(results) != k {
+			t.Fatal(results)
+		}
+		if results := f.QueryAdaptive(sig, 0); len(results) != 0 {
+			t.Fatal(results)
+		}
+	}
+
+	f := NewMinhashLSH16(256, 0.8, 0, HashedBandKeys())
+	sig := randomSignature(256, 1)
+	f.Add("same", sig)
+	near := make([]uint64, len(sig))
+	copy(near, sig)
+	for i := 1; i < len(near); i++ {
+		near[i]++
+	}
+	f.Add("near", near)
+	f.Index()
+	if results := f.QueryAdaptive(sig, 2); len(results) != 1 {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHQueryHistogram(t *testing.T) {
+	f := NewMinhashLSH16(100, 0.5, 4, StoreSignatures())
+	k, _ := f.Params()
+	sig := randomSignature(100, 1)
+	f.Add("same", sig)
+	f.Add("same2", sig)
+	// Differs from sig in 30 hash values, keeping the first band intact
+	// so it stays a candidate.
+	sim70 := make([]uint64, len(sig))
+	copy(sim70, sig)
+	for i := 0; i < 30; i++ {
+		sim70[len(sig)-1-i]++
+	}
+	if 30 > len(sig)-k {
+		t.Fatal("the first band is changed")
+	}
+	f.Add("sim70", sim70)
+	f.Add("far", randomSignature(100, 2))
+	f.Index()
+
+	groups := f.QueryHistogram(sig, 0.1)
+	if len(groups) != 2 || len(groups[10]) != 2 || len(groups[7]) != 1 || groups[7][0] != "sim70" {
+		t.Fatal(groups)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for zero bucket width")
+		}
+	}()
+	f.QueryHistogram(sig, 0)
+}
+
+func Test_MinhashLSHBandSegments(t *testing.T) {
+	f := NewMinhashLSH16(130, 0.5, 0)
+	k, l := f.Params()
+	sig := randomSignature(130, 1)
+	segments := f.BandSegments(sig)
+	if len(segments) != l {
+		t.Fatal(len(segments))
+	}
+	hashKeys := f.hashKeys(sig)
+	for i, segment := range segments {
+		if len(segment) != k || segment[0] != sig[i*k] {
+			t.Fatal(segment)
+		}
+		if f.hashKeyFunc(segment) != hashKeys[i] {
+			t.Fatal("expected the segments the band keys are made of")
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for a short signature")
+		}
+	}()
+	f.BandSegments(sig[:k*l-1])
+}
+
+func Test_MinhashLSHLeftoverHashValues(t *testing.T) {
+	// 11 of the 128 hash values are past the 9 bands of 13 hash values.
+	f := NewMinhashLSH16(128, 0.8, 2)
+	if k, l := f.Params(); k != 13 || l != 9 {
+		t.Fatalf("expected k = 13, l = 9, got k = %d, l = %d", k, l)
+	}
+	sig := randomSignature(128, 1)
+	// Differs from sig only in the leftover hash values.
+	leftover := make([]uint64, len(sig))
+	copy(leftover, sig)
+	for i := 117; i < 128; i++ {
+		leftover[i]++
+	}
+	// Differs from sig in all but the leftover hash values.
+	onlyLeftover := randomSignature(128, 2)
+	copy(onlyLeftover[117:], sig[117:])
+	f.Add("leftover", leftover)
+	f.Add("onlyLeftover", onlyLeftover)
+	f.Index()
+	if results := f.Query(sig); len(results) != 1 || results[0] != "leftover" {
+		t.Fatal(results)
+	}
+
+	f = NewMinhashLSH16(128, 0.8, 2, LeftoverHashValues(PadLeftoverHashValues), BandSeeds(1), StoreSignatures())
+	if k, l := f.Params(); k != 13 || l != 10 {
+		t.Fatalf("expected k = 13, l = 10, got k = %d, l = %d", k, l)
+	}
+	if segments := f.BandSegments(sig); len(segments) != 10 || len(segments[9]) != 11 {
+		t.Fatal(segments)
+	}
+	f.Add("leftover", leftover)
+	f.Add("onlyLeftover", onlyLeftover)
+	f.Index()
+	if results := f.QueryByBand(sig); len(results[9]) != 1 || results[9][0] != "onlyLeftover" {
+		t.Fatal(results)
+	}
+	if results := f.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+	// A linear scan of the stored signatures, fine for this small index.
+	if results, err := f.QueryBruteForce(sig, 1); err != nil || len(results) != 2 {
+		t.Fatal(results, err)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g MinhashLSH
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig); len(results) != 2 {
+		t.Fatal(results)
+	}
+
+	// 130 hash values are 10 bands of 13.
+	if k, l := NewMinhashLSH16(130, 0.8, 0, LeftoverHashValues(RejectLeftoverHashValues)).Params(); k*l != 130 {
+		t.Fatal(k, l)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for leftover hash values")
+		}
+	}()
+	NewMinhashLSH16(128, 0.8, 0, LeftoverHashValues(RejectLeftoverHashValues))
+}
+
+func Test_MinhashLSHStats(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 0, TrackStats())
+	_, l := f.Params()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	// Monitor the build from another goroutine.
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if stats := f.Stats(); stats.Entries < stats.IndexedEntries {
+					t.Error(stats)
+				}
+			}
+		}
+	}()
+	sig := randomSignature(256, 100)
+	for i := 0; i < 100; i++ {
+		if i%10 == 0 {
+			f.Add(i, sig)
+		} else {
+			f.Add(i, randomSignature(256, int64(i)))
+		}
+		if i%25 == 0 {
+			f.Index()
+		}
+	}
+	f.Add(0, sig)
+	if stats := f.Stats(); stats.Keys != 100 || stats.Entries != 101*l || stats.IndexedEntries != 76*l {
+		t.Fatal(stats)
+	}
+	f.Index()
+	close(done)
+	wg.Wait()
+
+	// Consistent with a scan of the built index.
+	expected := IndexStats{Keys: len(f.members), Entries: 101 * l, IndexedEntries: 101 * l}
+	for _, table := range f.hashTables {
+		if size := largestBucket(table); size > expected.MaxBucketSize {
+			expected.MaxBucketSize = size
+		}
+	}
+	if stats := f.Stats(); stats != expected || stats.MaxBucketSize != 11 {
+		t.Fatal(stats, expected)
+	}
+	if stats := NewMinhashLSH16(256, 0.6, 0).Stats(); stats != (IndexStats{}) {
+		t.Fatal(stats)
+	}
+}
+
+func Test_MinhashLSHQueryExplain(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 0, StoreSignatures())
+	k, l := f.Params()
+	sig := randomSignature(256, 1)
+	// Collides with sig in the first band only.
+	firstBand := randomSignature(256, 2)
+	copy(firstBand, sig[:k])
+	f.Add("same", sig)
+	f.Add("firstBand", firstBand)
+	f.Add("far", randomSignature(256, 3))
+	f.Index()
+
+	explanations := f.QueryExplain(sig)
+	if len(explanations) != l {
+		t.Fatal(explanations)
+	}
+	first := explanations[0]
+	if first.Band != 0 || first.HashKey != f.hashKeys(sig)[0] || len(first.Candidates) != 2 {
+		t.Fatal(first)
+	}
+	if c := first.Candidates[0]; c.Key != "same" || c.Similarity != 1 || c.BandMatches != l {
+		t.Fatal(c)
+	}
+	if c := first.Candidates[1]; c.Key != "firstBand" || c.BandMatches != 1 {
+		t.Fatal(c)
+	}
+	for i, e := range explanations[1:] {
+		if e.Band != i+1 || len(e.Candidates) != 1 {
+			t.Fatal(e)
+		}
+	}
+	if explanations := f.QueryExplain(randomSignature(256, 4)); len(explanations) != 0 {
+		t.Fatal(explanations)
+	}
+}
@@ -1,9 +1,16 @@
 package minhashlsh
 
 import (
+	"bytes"
+	"encoding"
 	"encoding/binary"
+	"fmt"
 	"hash/fnv"
+	"math"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 
 	minwise "github.com/dgryski/go-minhash"
 )
@@ -13,19 +20,58 @@ const hashValueSize = 8
 
 // Minhash represents a MinHash object
 type Minhash struct {
-	mw   *minwise.MinWise
-	seed int64
+	mw *minwise.MinWise
+	// seed1 and seed2 are the seeds of the two hash functions
+	seed1 uint64
+	seed2 uint64
+	// buf holds the encoding of integer values pushed
+	buf [8]byte
+	// stopwords are the values ignored by the push methods
+	stopwords map[string]struct{}
 }
 
 // NewMinhash initialize a MinHash object with a seed and the number of
 // hash functions.
 func NewMinhash(seed int64, numHash int) *Minhash {
+	seed1, seed2 := HasherSeeds(seed)
+	return NewMinhashWithHasherSeeds(seed1, seed2, numHash)
+}
+
+// HasherSeeds returns the seeds of the two hash functions derived from
+// seed by NewMinhash. They can be stored and passed to
+// NewMinhashWithHasherSeeds to reproduce signatures without relying on
+// math/rand.
+func HasherSeeds(seed int64) (seed1, seed2 uint64) {
 	r := rand.New(rand.NewSource(seed))
+	seed1 = uint64(r.Int63())
+	seed2 = uint64(r.Int63())
+	return seed1, seed2
+}
+
+// NewMinhashWithRand initialize a MinHash object with the seeds of its
+// two hash functions drawn from r, e.g. a generator whose algorithm the
+// caller controls, and the number of hash functions. Drawing from
+// rand.New(rand.NewSource(seed)) gives the same signatures as
+// NewMinhash(seed, numHash). As r advances, the Minhash objects created
+// from the same r have different seeds and cannot be merged; to create
+// several compatible ones, pass the Seeds of the first to
+// NewMinhashWithHasherSeeds.
+func NewMinhashWithRand(r *rand.Rand, numHash int) *Minhash {
+	seed1 := uint64(r.Int63())
+	seed2 := uint64(r.Int63())
+	return NewMinhashWithHasherSeeds(seed1, seed2, numHash)
+}
+
+// NewMinhashWithHasherSeeds initialize a MinHash object with the seeds
+// of its two hash functions and the number of hash functions.
+// NewMinhash(seed, numHash) is the same as calling it with the seeds
+// returned by HasherSeeds(seed).
+func NewMinhashWithHasherSeeds(seed1, seed2 uint64, numHash int) *Minhash {
 	b := binary.BigEndian
 	b1 := make([]byte, hashValueSize)
 	b2 := make([]byte, hashValueSize)
-	b.PutUint64(b1, uint64(r.Int63()))
-	b.PutUint64(b2, uint64(r.Int63()))
+	b.PutUint64(b1, seed1)
+	b.PutUint64(b2, seed2)
 	fnv1 := fnv.New64a()
 	fnv2 := fnv.New64a()
 	h1 := func(b []byte) uint64 {
@@ -41,28 +87,391 @@ func NewMinhash(seed int64, numHash int) *Minhash {
 		return fnv2.Sum64()
 	}
 	return &Minhash{
-		mw:   minwise.NewMinWise(h1, h2, numHash),
-		seed: int64(seed),
+		mw:    minwise.NewMinWise(h1, h2, numHash),
+		seed1: seed1,
+		seed2: seed2,
 	}
 }
 
 // Push a new value to the MinHash object.
 // The value should be serialized to byte slice.
+// MinHash represents sets, so pushing a value that was already pushed
+// does not change the signature.
 func (m *Minhash) Push(b []byte) {
+	m.push(b)
+}
+
+// push pushes the value unless it is a stopword.
+func (m *Minhash) push(b []byte) {
+	if m.stopwords != nil {
+		if _, stop := m.stopwords[string(b)]; stop {
+			return
+		}
+	}
 	m.mw.Push(b)
 }
 
+// SetStopwords makes the push methods ignore the stopwords, values so
+// frequent, e.g. in nearly every set, that they add noise to the
+// similarities, replacing the stopwords set before. Values already pushed
+// are not removed. A value is ignored if the bytes hashed for it, e.g.
+// the encoding of PushUint64 or the NFC form of normalize.Push, are those
+// of a stopword; PushWeighted ignores a value that is a stopword before
+// its expansion. Signatures are only comparable, or mergeable, if they are
+// built with the same stopwords.
+func (m *Minhash) SetStopwords(stopwords [][]byte) {
+	m.stopwords = make(map[string]struct{}, len(stopwords))
+	for _, w := range stopwords {
+		m.stopwords[string(w)] = struct{}{}
+	}
+}
+
+// PushUint64 pushes an integer value, such as a feature ID, hashing its
+// 8-byte big endian encoding without converting it to a string.
+// The signature differs from pushing the bytes of the decimal string of
+// the value, so signatures to be compared must consistently use either.
+func (m *Minhash) PushUint64(v uint64) {
+	binary.BigEndian.PutUint64(m.buf[:], v)
+	m.push(m.buf[:])
+}
+
+// PushUint64Batch pushes every value of vs as PushUint64 does, e.g. the
+// 64-bit hashes of the k-mers of a sequence, reusing a single buffer for
+// their encoding. The signature is the same as pushing the values one by
+// one with PushUint64, so it is only comparable with signatures of values
+// pushed as integers, not of byte slices or strings of the same values.
+func (m *Minhash) PushUint64Batch(vs []uint64) {
+	b := m.buf[:]
+	for _, v := range vs {
+		binary.BigEndian.PutUint64(b, v)
+		m.push(b)
+	}
+}
+
+// PushSet pushes the unique elements of a set in sorted order, so the
+// signature is the same whatever the order and repetitions of the
+// elements. The elements are not modified.
+func (m *Minhash) PushSet(elements [][]byte) {
+	sorted := make(byteSlices, len(elements))
+	copy(sorted, elements)
+	sort.Sort(sorted)
+	for i, b := range sorted {
+		if i > 0 && bytes.Equal(b, sorted[i-1]) {
+			continue
+		}
+		m.push(b)
+	}
+}
+
+// byteSlices sorts byte slices in lexicographic order.
+type byteSlices [][]byte
+
+func (s byteSlices) Len() int           { return len(s) }
+func (s byteSlices) Less(i, j int) bool { return bytes.Compare(s[i], s[j]) < 0 }
+func (s byteSlices) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// PushValue pushes a structured value, such as a record, serialized by
+// extract, e.g. to a chosen field or a composite key of the record.
+// If extract is nil, the value must be a []byte, a string, an
+// encoding.BinaryMarshaler or a fmt.Stringer, which is serialized by
+// MarshalBinary or String respectively, otherwise an error is returned.
+// The signature only depends on the bytes pushed, so extract, or the
+// MarshalBinary or String methods, must be deterministic, and equal
+// values must be serialized to equal bytes.
+func (m *Minhash) PushValue(v interface{}, extract func(interface{}) []byte) error {
+	if extract != nil {
+		m.push(extract(v))
+		return nil
+	}
+	switch v := v.(type) {
+	case []byte:
+		m.push(v)
+	case string:
+		m.push([]byte(v))
+	case encoding.BinaryMarshaler:
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		m.push(b)
+	case fmt.Stringer:
+		m.push([]byte(v.String()))
+	default:
+		return fmt.Errorf("Cannot push value of type %T without an extractor", v)
+	}
+	return nil
+}
+
+// MaxWeight is the largest weight accepted by PushWeighted.
+const MaxWeight = 1 << 16
+
+// ErrWeightTooLarge is returned by PushWeighted for a weight above
+// MaxWeight.
+var ErrWeightTooLarge = fmt.Errorf("Weights must be at most %d", MaxWeight)
+
+// PushWeighted pushes a value with an integer weight, such as its count
+// in a bag of words, for estimating the weighted Jaccard similarity
+// sum(min(w1, w2))/sum(max(w1, w2)) of the weights of all values. The
+// value is expanded to weight distinct elements, each being the value
+// followed by the 8-byte big endian encoding of its position, so weighted
+// signatures are not comparable with the signatures of Push, and pushing
+// the same value again with a larger weight increases its weight to that
+// weight. The cost is proportional to the weight, so a weight above
+// MaxWeight is rejected with ErrWeightTooLarge and nothing is pushed.
+func (m *Minhash) PushWeighted(b []byte, weight int) error {
+	if weight > MaxWeight {
+		return ErrWeightTooLarge
+	}
+	if _, stop := m.stopwords[string(b)]; stop {
+		return nil
+	}
+	e := make([]byte, len(b)+8)
+	copy(e, b)
+	for i := 0; i < weight; i++ {
+		binary.BigEndian.PutUint64(e[len(b):], uint64(i))
+		m.mw.Push(e)
+	}
+	return nil
+}
+
+// ApplyDelta updates the Minhash for a revision of its set, in which the
+// values added were inserted and the values removed were deleted.
+// MinHash supports insertion only: for an add-only revision the added
+// values are pushed and the Minhash is updated in place. A removal cannot
+// be undone, so if removed is not empty the Minhash is recomputed from
+// values, which must then be all the values of the revised set, and
+// ApplyDelta returns true to report the full recomputation.
+func (m *Minhash) ApplyDelta(added, removed, values [][]byte) (recomputed bool) {
+	if len(removed) == 0 {
+		for _, v := range added {
+			m.Push(v)
+		}
+		return false
+	}
+	fresh := NewMinhashWithHasherSeeds(m.seed1, m.seed2, m.NumHash())
+	fresh.stopwords = m.stopwords
+	for _, v := range values {
+		fresh.Push(v)
+	}
+	m.mw = fresh.mw
+	return true
+}
+
+// IsEmpty returns true if no value was pushed, i.e. all the hash values
+// are still the maximum. The signature of an empty set collides with
+// every other empty one in the index, so such sets should be skipped or
+// flagged before they are added.
+func (m *Minhash) IsEmpty() bool {
+	return isEmptySignature(m.mw.Signature())
+}
+
 // Signature exports the MinHash as a list of hash values.
 func (m *Minhash) Signature() []uint64 {
 	return m.mw.Signature()
 }
 
+// NumHash returns the number of hash functions, which is the
+// size of the signature.
+func (m *Minhash) NumHash() int {
+	return len(m.mw.Signature())
+}
+
+// EstimationStdErr returns the standard error sqrt(j(1-j)/numHash) of the
+// Jaccard similarity estimated from signatures of this size, when the true
+// Jaccard similarity is atJaccard. It assumes the hash functions are
+// independent, so the number of matching hash values is binomial, with
+// numHash trials of probability atJaccard; it is the largest at 0.5 and
+// zero at 0 and 1. It panics if atJaccard is not between 0 and 1.
+func (m *Minhash) EstimationStdErr(atJaccard float64) float64 {
+	if atJaccard < 0 || atJaccard > 1 {
+		panic("Jaccard similarity must be between 0 and 1")
+	}
+	return math.Sqrt(atJaccard * (1 - atJaccard) / float64(m.NumHash()))
+}
+
+// Seeds returns the seeds of the two hash functions, which Merge requires
+// to be the same for both Minhash objects.
+func (m *Minhash) Seeds() (seed1, seed2 uint64) {
+	return m.seed1, m.seed2
+}
+
 // Merge combines the signature of the other Minhash
 // with this one, making this one carry the signature of
 // the union.
 func (m *Minhash) Merge(o *Minhash) {
-	if m.seed != o.seed {
+	if m.seed1 != o.seed1 || m.seed2 != o.seed2 {
 		panic("Cannot merge Minhash with different seed")
 	}
-	m.mw.Merge(o.mw)
+	// The signatures are the minimums of the MinWise objects, not copies.
+	if err := MergeSignatures(m.mw.Signature(), o.mw.Signature()); err != nil {
+		panic("Cannot merge Minhash with different number of hash functions")
+	}
+}
+
+// Jaccard returns the estimated Jaccard similarity of the sets of this
+// Minhash and the other one. It panics if they have different seeds or
+// numbers of hash functions: the i-th hash value of a signature is the
+// minimum of the i-th hash function over the set, so hash values of
+// different seeds are minimums of unrelated hash functions, and are equal
+// by chance only whatever the sets, e.g. two Minhash of different seeds
+// over the same set estimate a similarity near 0, not 1. Use
+// ReferenceJaccards to check Minhash of different seeds instead.
+func (m *Minhash) Jaccard(o *Minhash) float64 {
+	if m.seed1 != o.seed1 || m.seed2 != o.seed2 {
+		panic("Cannot compare Minhash with different seed")
+	}
+	j, err := EstimateJaccard(m.Signature(), o.Signature())
+	if err != nil {
+		panic("Cannot compare Minhash with different number of hash functions")
+	}
+	return j
+}
+
+// ReferenceJaccards returns the estimated Jaccard similarities of the sets
+// of a and b, which can have different seeds, with the reference set,
+// each computed from a signature of the reference with the seeds and
+// number of hash functions of a and b respectively, as they cannot be
+// compared directly. It is meant for tests, e.g. to check that Minhash of
+// different seeds over the same data estimate about the same similarity
+// with the reference, within a few times EstimationStdErr.
+func ReferenceJaccards(a, b *Minhash, reference [][]byte) (jaccardA, jaccardB float64) {
+	refA := NewMinhashWithHasherSeeds(a.seed1, a.seed2, a.NumHash())
+	refB := NewMinhashWithHasherSeeds(b.seed1, b.seed2, b.NumHash())
+	for _, v := range reference {
+		refA.Push(v)
+		refB.Push(v)
+	}
+	return a.Jaccard(refA), b.Jaccard(refB)
+}
+
+// MultiMinhash computes the MinHash signatures of a set with several
+// seeds in a single pass over its values, e.g. for an ensemble of indexes
+// each using signatures of a different seed.
+type MultiMinhash struct {
+	minhashes []*Minhash
+}
+
+// NewMultiMinhash initialize a MultiMinhash with one Minhash for every
+// seed, each with numHash hash functions.
+func NewMultiMinhash(seeds []int64, numHash int) *MultiMinhash {
+	minhashes := make([]*Minhash, len(seeds))
+	for i, seed := range seeds {
+		minhashes[i] = NewMinhash(seed, numHash)
+	}
+	return &MultiMinhash{minhashes}
+}
+
+// Push a new value to the Minhash of every seed.
+func (m *MultiMinhash) Push(b []byte) {
+	for _, mh := range m.minhashes {
+		mh.Push(b)
+	}
+}
+
+// Signatures exports the signatures of all seeds, the i-th signature is
+// the same as the one of NewMinhash with the i-th seed.
+func (m *MultiMinhash) Signatures() [][]uint64 {
+	sigs := make([][]uint64, len(m.minhashes))
+	for i, mh := range m.minhashes {
+		sigs[i] = mh.Signature()
+	}
+	return sigs
+}
+
+// MinhashText returns the MinHash signature of the set of tokens of text,
+// split by tokenize, using NewMinhash(seed, numHash). If tokenize is nil,
+// the text is split around whitespace by strings.Fields.
+// The tokens are the elements of the set, so signatures of texts split
+// by different tokenizers, e.g. words and shingles, are not comparable.
+func MinhashText(text string, seed int64, numHash int, tokenize func(string) []string) []uint64 {
+	if tokenize == nil {
+		tokenize = strings.Fields
+	}
+	mh := NewMinhash(seed, numHash)
+	for _, token := range tokenize(text) {
+		mh.Push([]byte(token))
+	}
+	return mh.Signature()
+}
+
+// Signatures computes the MinHash signatures of the sets using the given
+// number of worker goroutines, each set is a slice of serialized values.
+// The i-th signature belongs to the i-th set, and is the same as the one
+// created by pushing the values of the set into NewMinhash(seed, numHash).
+func Signatures(sets [][][]byte, seed int64, numHash, workers int) [][]uint64 {
+	if workers < 1 {
+		workers = 1
+	}
+	sigs := make([][]uint64, len(sets))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				mh := NewMinhash(seed, numHash)
+				for _, v := range sets[i] {
+					mh.Push(v)
+				}
+				sigs[i] = mh.Signature()
+			}
+		}()
+	}
+	for i := range sets {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return sigs
+}
+
+// ExactJaccard computes the exact Jaccard similarity of the two sets of
+// serialized values, duplicate values are counted once. Unlike the
+// estimates from signatures, it requires the original values, and is
+// useful for verifying candidates and measuring estimation errors.
+// The similarity of two empty sets is 0.
+func ExactJaccard(a, b [][]byte) float64 {
+	setA := make(map[string]bool, len(a))
+	for _, v := range a {
+		setA[string(v)] = true
+	}
+	setB := make(map[string]bool, len(b))
+	for _, v := range b {
+		setB[string(v)] = true
+	}
+	var intersection int
+	for v := range setB {
+		if setA[v] {
+			intersection++
+		}
+	}
+	union := len(setA) + len(setB) - intersection
+	if union == 0 {
+		return 0
+	}
+	return float64(intersection) / float64(union)
+}
+
+// cardinality estimates the number of distinct values pushed to
+// create the signature, assuming the hash values are uniformly
+// distributed over the range of uint64
+// (http://www.cohenwang.com/edith/Papers/tcest.pdf).
+func cardinality(sig []uint64) float64 {
+	var sum float64
+	for _, v := range sig {
+		sum += -math.Log(float64(math.MaxUint64-v) / float64(math.MaxUint64))
+	}
+	return float64(len(sig)-1) / sum
+}
+
+// isEmptySignature returns true if no value was pushed to create
+// the signature, i.e. all of its hash values are still the maximum.
+func isEmptySignature(sig []uint64) bool {
+	for _, v := range sig {
+		if v != math.MaxUint64 {
+			return false
+		}
+	}
+	return true
 }
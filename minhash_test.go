@@ -1,8 +1,13 @@
 package minhashlsh
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -11,6 +16,59 @@ func TestMinhash(t *testing.T) {
 	m.Push([]byte("Test some input"))
 }
 
+func TestSignatures(t *testing.T) {
+	sets := make([][][]byte, 100)
+	for i := range sets {
+		sets[i] = data(i + 1)
+	}
+	sigs := Signatures(sets, 1, 64, 4)
+	if len(sigs) != len(sets) {
+		t.Fatal(len(sigs))
+	}
+	for i, set := range sets {
+		mh := NewMinhash(1, 64)
+		for _, v := range set {
+			mh.Push(v)
+		}
+		expected := mh.Signature()
+		for j := range expected {
+			if sigs[i][j] != expected[j] {
+				t.Fatalf("signature %d differs from serial construction", i)
+			}
+		}
+	}
+}
+
+// referenceTokens are the values of the reference signature
+// pinned by ExampleNewMinhash and TestMinhashReferenceSignature.
+var referenceTokens = strings.Fields("the quick brown fox jumps over the lazy dog")
+
+// ExampleNewMinhash shows the reference signature of NewMinhash(42, 128)
+// over referenceTokens. The signature must never change, as stored
+// signatures would become incomparable with new ones, and it can be used
+// to check other implementations for conformance.
+func ExampleNewMinhash() {
+	m := NewMinhash(42, 128)
+	for _, token := range referenceTokens {
+		m.Push([]byte(token))
+	}
+	fmt.Println(m.Signature()[:4])
+	// Output: [4595860520452413771 990341090959575880 1896959253223490792 1899415010295704088]
+}
+
+func TestMinhashReferenceSignature(t *testing.T) {
+	m := NewMinhash(42, 128)
+	for _, token := range referenceTokens {
+		m.Push([]byte(token))
+	}
+	// The FNV-1a digest of the whole signature serialized by SigToBytes.
+	h := fnv.New64a()
+	h.Write(SigToBytes(m.Signature()))
+	if digest := h.Sum64(); digest != 0xec28661b6f49add9 {
+		t.Fatalf("reference signature changed, digest %#x", digest)
+	}
+}
+
 func data(size int) [][]byte {
 	d := make([][]byte, size)
 	for i := range d {
@@ -67,3 +125,401 @@ func BenchmarkMinWise256(b *testing.B) {
 func BenchmarkMinWise512(b *testing.B) {
 	benchmark(512, b.N, b)
 }
+
+func benchmarkSignatures(workers int, b *testing.B) {
+	sets := make([][][]byte, 1000)
+	for i := range sets {
+		sets[i] = data(100)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		Signatures(sets, 1, 128, workers)
+	}
+}
+
+func BenchmarkSignatures1(b *testing.B) {
+	benchmarkSignatures(1, b)
+}
+
+func BenchmarkSignatures2(b *testing.B) {
+	benchmarkSignatures(2, b)
+}
+
+func BenchmarkSignatures4(b *testing.B) {
+	benchmarkSignatures(4, b)
+}
+
+func BenchmarkSignatures8(b *testing.B) {
+	benchmarkSignatures(8, b)
+}
+
+func TestNewMinhashWithHasherSeeds(t *testing.T) {
+	seed1, seed2 := HasherSeeds(42)
+	m1 := NewMinhash(42, 64)
+	m2 := NewMinhashWithHasherSeeds(seed1, seed2, 64)
+	for _, v := range data(100) {
+		m1.Push(v)
+		m2.Push(v)
+	}
+	sig1, sig2 := m1.Signature(), m2.Signature()
+	for i := range sig1 {
+		if sig1[i] != sig2[i] {
+			t.Fatal("signatures differ")
+		}
+	}
+	// Minhash with the same hasher seeds can be merged.
+	m1.Merge(m2)
+}
+
+func TestNewMinhashWithRand(t *testing.T) {
+	m1 := NewMinhash(42, 64)
+	m2 := NewMinhashWithRand(rand.New(rand.NewSource(42)), 64)
+	if seed1, seed2 := m2.Seeds(); seed1 != m1.seed1 || seed2 != m1.seed2 {
+		t.Fatal("expected the seeds of NewMinhash")
+	}
+	r := rand.New(rand.NewSource(1))
+	m3 := NewMinhashWithRand(r, 64)
+	m4 := NewMinhashWithRand(r, 64)
+	if seed1, _ := m3.Seeds(); seed1 == m4.seed1 {
+		t.Fatal("expected different seeds from an advancing generator")
+	}
+	// Compatible with a Minhash created from its seeds.
+	seed1, seed2 := m3.Seeds()
+	m3.Merge(NewMinhashWithHasherSeeds(seed1, seed2, 64))
+}
+
+func TestMinhashJaccardDifferentSeeds(t *testing.T) {
+	d := data(1000)
+	m1 := NewMinhash(1, 256)
+	m2 := NewMinhash(2, 256)
+	for _, v := range d {
+		m1.Push(v)
+		m2.Push(v)
+	}
+	// The same set, but the hash values of different seeds are unrelated.
+	if j, _ := EstimateJaccard(m1.Signature(), m2.Signature()); j > 0.1 {
+		t.Fatalf("expected a similarity near 0 across seeds, got %f", j)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic comparing Minhash of different seeds")
+			}
+		}()
+		m1.Jaccard(m2)
+	}()
+
+	// Half of the reference is in the set.
+	reference := append(d[500:], data(500)...)
+	j1, j2 := ReferenceJaccards(m1, m2, reference)
+	exact := ExactJaccard(d, reference)
+	tolerance := 4 * m1.EstimationStdErr(exact)
+	if math.Abs(j1-exact) > tolerance || math.Abs(j2-exact) > tolerance {
+		t.Fatalf("expected about %f for both seeds, got %f and %f", exact, j1, j2)
+	}
+}
+
+func TestMinhashSetStopwords(t *testing.T) {
+	words := [][]byte{[]byte("the"), []byte("cat"), []byte("a"), []byte("hat")}
+	m1 := NewMinhash(1, 64)
+	m1.SetStopwords([][]byte{[]byte("the"), []byte("a")})
+	for _, w := range words {
+		m1.Push(w)
+	}
+	m2 := NewMinhash(1, 64)
+	m2.Push([]byte("cat"))
+	m2.Push([]byte("hat"))
+	if j := m1.Jaccard(m2); j != 1 {
+		t.Fatalf("expected the stopwords to be ignored, got %f", j)
+	}
+
+	// Recomputed with the same stopwords.
+	m1.ApplyDelta(nil, words[1:2], append(words[:1], words[2:]...))
+	m3 := NewMinhash(1, 64)
+	m3.Push([]byte("hat"))
+	if j := m1.Jaccard(m3); j != 1 {
+		t.Fatalf("expected the stopwords to be kept by ApplyDelta, got %f", j)
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, 7)
+	m4 := NewMinhash(1, 64)
+	m4.SetStopwords([][]byte{b, []byte("hat")})
+	m4.PushUint64Batch([]uint64{7, 8})
+	m4.PushWeighted([]byte("hat"), 3)
+	m5 := NewMinhash(1, 64)
+	m5.PushUint64(8)
+	if j := m4.Jaccard(m5); j != 1 {
+		t.Fatalf("expected the stopwords to be ignored, got %f", j)
+	}
+}
+
+func TestMinhashApplyDelta(t *testing.T) {
+	d := data(20)
+	expected := NewMinhash(1, 64)
+	for _, v := range d[:15] {
+		expected.Push(v)
+	}
+
+	// Add-only revision is applied in place.
+	m := NewMinhash(1, 64)
+	for _, v := range d[:10] {
+		m.Push(v)
+	}
+	if m.ApplyDelta(d[10:15], nil, nil) {
+		t.Fatal("add-only revision should not recompute")
+	}
+	if j, _ := EstimateJaccard(m.Signature(), expected.Signature()); j != 1 {
+		t.Fatal("signature differs after add-only revision")
+	}
+
+	// Revision with removals is recomputed from the revised set.
+	m = NewMinhash(1, 64)
+	for _, v := range d {
+		m.Push(v)
+	}
+	if !m.ApplyDelta(nil, d[15:], d[:15]) {
+		t.Fatal("revision with removals should recompute")
+	}
+	if j, _ := EstimateJaccard(m.Signature(), expected.Signature()); j != 1 {
+		t.Fatal("signature differs after revision with removals")
+	}
+}
+
+func TestMinhashPushRepeated(t *testing.T) {
+	m1 := NewMinhash(1, 64)
+	m2 := NewMinhash(1, 64)
+	for _, v := range data(10) {
+		m1.Push(v)
+		for i := 0; i < 5; i++ {
+			m2.Push(v)
+		}
+	}
+	if j, _ := EstimateJaccard(m1.Signature(), m2.Signature()); j != 1 {
+		t.Fatal("pushing a value repeatedly should not change the signature")
+	}
+}
+
+func TestMinhashPushUint64(t *testing.T) {
+	m1 := NewMinhash(1, 64)
+	m2 := NewMinhash(1, 64)
+	m3 := NewMinhash(1, 64)
+	for i := uint64(0); i < 100; i++ {
+		m1.PushUint64(i)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, i)
+		m2.Push(b)
+		m3.Push([]byte(strconv.FormatUint(i, 10)))
+	}
+	if j, _ := EstimateJaccard(m1.Signature(), m2.Signature()); j != 1 {
+		t.Fatal("expected the same signature as pushing the big endian encoding")
+	}
+	if j, _ := EstimateJaccard(m1.Signature(), m3.Signature()); j == 1 {
+		t.Fatal("expected a different signature from pushing decimal strings")
+	}
+}
+
+func TestMinhashPushUint64Batch(t *testing.T) {
+	m1 := NewMinhash(1, 64)
+	m2 := NewMinhash(1, 64)
+	kmers := make([]uint64, 100)
+	for i := range kmers {
+		kmers[i] = uint64(i) * 0x9e3779b97f4a7c15
+		m1.PushUint64(kmers[i])
+	}
+	m2.PushUint64Batch(kmers[:50])
+	m2.PushUint64Batch(kmers[50:])
+	m2.PushUint64Batch(nil)
+	if j, _ := EstimateJaccard(m1.Signature(), m2.Signature()); j != 1 {
+		t.Fatal("expected the same signature as pushing the values one by one")
+	}
+}
+
+func TestMinhashIsEmpty(t *testing.T) {
+	m := NewMinhash(1, 64)
+	if !m.IsEmpty() {
+		t.Fatal("expected a new Minhash to be empty")
+	}
+	m.SetStopwords([][]byte{[]byte("the")})
+	m.Push([]byte("the"))
+	if !m.IsEmpty() {
+		t.Fatal("expected a Minhash of stopwords only to be empty")
+	}
+	m.Push([]byte("hat"))
+	if m.IsEmpty() {
+		t.Fatal("expected a Minhash with a value not to be empty")
+	}
+}
+
+func TestMinhashMerge(t *testing.T) {
+	d := data(100)
+	m1, m2, union := NewMinhash(1, 1024), NewMinhash(1, 1024), NewMinhash(1, 1024)
+	for i, v := range d {
+		if i < 60 {
+			m1.Push(v)
+		}
+		if i >= 40 {
+			m2.Push(v)
+		}
+		union.Push(v)
+	}
+	m1.Merge(m2)
+	for i, v := range union.Signature() {
+		if m1.Signature()[i] != v {
+			t.Fatal("expected the signature of the union")
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for different number of hash functions")
+		}
+	}()
+	m1.Merge(NewMinhash(1, 64))
+}
+
+func TestMinhashPushSet(t *testing.T) {
+	d := data(50)
+	m1 := NewMinhash(1, 64)
+	m1.PushSet(d)
+	shuffled := make([][]byte, 0, 2*len(d))
+	for _, i := range rand.New(rand.NewSource(1)).Perm(len(d)) {
+		shuffled = append(shuffled, d[i], d[i])
+	}
+	first := shuffled[0]
+	m2 := NewMinhash(1, 64)
+	m2.PushSet(shuffled)
+	for i, v := range m1.Signature() {
+		if m2.Signature()[i] != v {
+			t.Fatal("expected the same signature for shuffled and repeated elements")
+		}
+	}
+	if &shuffled[0][0] != &first[0] {
+		t.Fatal("expected the elements not to be modified")
+	}
+}
+
+func TestMultiMinhash(t *testing.T) {
+	seeds := []int64{1, 2, 3}
+	m := NewMultiMinhash(seeds, 64)
+	d := data(100)
+	for _, v := range d {
+		m.Push(v)
+	}
+	sigs := m.Signatures()
+	if len(sigs) != len(seeds) {
+		t.Fatal(len(sigs))
+	}
+	for i, seed := range seeds {
+		mh := NewMinhash(seed, 64)
+		for _, v := range d {
+			mh.Push(v)
+		}
+		if j, _ := EstimateJaccard(sigs[i], mh.Signature()); j != 1 {
+			t.Fatalf("signature of seed %d differs from NewMinhash", seed)
+		}
+	}
+}
+
+type record struct {
+	ID    int
+	Title string
+}
+
+func (r record) String() string {
+	return r.Title
+}
+
+func TestMinhashPushValue(t *testing.T) {
+	records := []record{{1, "a"}, {2, "b"}, {3, "c"}}
+	m1 := NewMinhash(1, 64)
+	m2 := NewMinhash(1, 64)
+	m3 := NewMinhash(1, 64)
+	title := func(v interface{}) []byte {
+		return []byte(v.(record).Title)
+	}
+	for _, r := range records {
+		if err := m1.PushValue(r, title); err != nil {
+			t.Fatal(err)
+		}
+		// Uses String.
+		if err := m2.PushValue(r, nil); err != nil {
+			t.Fatal(err)
+		}
+		m3.Push([]byte(r.Title))
+	}
+	for _, m := range []*Minhash{m1, m2} {
+		if j, _ := EstimateJaccard(m.Signature(), m3.Signature()); j != 1 {
+			t.Fatal("expected the same signature as pushing the serialized values")
+		}
+	}
+	if err := m1.PushValue(1.5, nil); err == nil {
+		t.Fatal("expected error for a value without extractor")
+	}
+}
+
+func TestMinhashText(t *testing.T) {
+	text := "the quick  brown fox\tjumps"
+	mh := NewMinhash(1, 64)
+	for _, token := range []string{"the", "quick", "brown", "fox", "jumps"} {
+		mh.Push([]byte(token))
+	}
+	if j, _ := EstimateJaccard(MinhashText(text, 1, 64, nil), mh.Signature()); j != 1 {
+		t.Fatal("expected the signature of the whitespace separated tokens")
+	}
+	lower := func(s string) []string {
+		return strings.Fields(strings.ToLower(s))
+	}
+	if j, _ := EstimateJaccard(MinhashText("THE Quick brown FOX jumps", 1, 64, lower), mh.Signature()); j != 1 {
+		t.Fatal("expected the signature of the custom tokens")
+	}
+}
+
+func TestMinhashPushWeighted(t *testing.T) {
+	m1 := NewMinhash(1, 512)
+	m2 := NewMinhash(1, 512)
+	// The weighted Jaccard similarity is (2 + 1) / (4 + 2) = 0.5.
+	if err := m1.PushWeighted([]byte("a"), MaxWeight+1); err != ErrWeightTooLarge {
+		t.Fatal("expected ErrWeightTooLarge, got", err)
+	}
+	if !m1.IsEmpty() {
+		t.Fatal("expected nothing pushed for a too large weight")
+	}
+	m1.PushWeighted([]byte("a"), 4)
+	m1.PushWeighted([]byte("b"), 1)
+	m2.PushWeighted([]byte("a"), 2)
+	m2.PushWeighted([]byte("b"), 2)
+	j, _ := EstimateJaccard(m1.Signature(), m2.Signature())
+	if math.Abs(j-0.5) > 0.1 {
+		t.Fatalf("expected about 0.5, got %.2f", j)
+	}
+}
+
+func TestMinhashEstimationStdErr(t *testing.T) {
+	m := NewMinhash(1, 100)
+	if e := m.EstimationStdErr(0.5); math.Abs(e-0.05) > 1e-12 {
+		t.Errorf("expected 0.05, got %f", e)
+	}
+	if e := m.EstimationStdErr(1); e != 0 {
+		t.Errorf("expected 0, got %f", e)
+	}
+	if m.EstimationStdErr(0.9) >= m.EstimationStdErr(0.5) {
+		t.Error("expected the largest error at 0.5")
+	}
+	if e := NewMinhash(1, 400).EstimationStdErr(0.5); math.Abs(e-0.025) > 1e-12 {
+		t.Errorf("expected 0.025, got %f", e)
+	}
+}
+
+func TestExactJaccard(t *testing.T) {
+	d := data(10)
+	if j := ExactJaccard(d[:6], d[3:]); j != 0.3 {
+		t.Fatal(j)
+	}
+	// Duplicates are ignored.
+	if j := ExactJaccard(append(d[:2:2], d[0]), d[:2]); j != 1 {
+		t.Fatal(j)
+	}
+	if j := ExactJaccard(nil, nil); j != 0 {
+		t.Fatal(j)
+	}
+}
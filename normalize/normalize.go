@@ -0,0 +1,18 @@
+// Package normalize pushes Unicode normalized strings into a Minhash.
+// It is kept apart from package minhashlsh so that the core package does
+// not depend on golang.org/x/text.
+package normalize
+
+import (
+	minhashlsh "github.com/ekzhu/minhash-lsh"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Push pushes a UTF-8 encoded string value into m after applying
+// Unicode NFC normalization, so that canonically equivalent strings,
+// e.g. from sources using NFC and NFD, are the same value.
+// For values that are not in NFC, the signature differs from using
+// m.Push, so signatures to be compared must consistently use either.
+func Push(m *minhashlsh.Minhash, s string) {
+	m.Push(norm.NFC.Bytes([]byte(s)))
+}
@@ -0,0 +1,24 @@
+package normalize
+
+import (
+	"testing"
+
+	minhashlsh "github.com/ekzhu/minhash-lsh"
+)
+
+func TestPush(t *testing.T) {
+	nfc := "caf\u00e9"
+	nfd := "cafe\u0301"
+	m1 := minhashlsh.NewMinhash(1, 64)
+	m2 := minhashlsh.NewMinhash(1, 64)
+	Push(m1, nfc)
+	Push(m2, nfd)
+	if j, _ := minhashlsh.EstimateJaccard(m1.Signature(), m2.Signature()); j != 1 {
+		t.Fatal("canonically equivalent strings should have the same signature")
+	}
+	m3 := minhashlsh.NewMinhash(1, 64)
+	m3.Push([]byte(nfd))
+	if j, _ := minhashlsh.EstimateJaccard(m2.Signature(), m3.Signature()); j == 1 {
+		t.Fatal("normalized and raw values should differ")
+	}
+}
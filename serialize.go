@@ -0,0 +1,640 @@
+package minhashlsh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// The binary format of MinhashLSH starts with this magic string
+// followed by the format version. Version 1 stores the flags in a single
+// byte, version 2 as a uvarint to make room for more flags.
+const (
+	binaryMagic   = "MLSH"
+	binaryVersion = 2
+)
+
+// Flags recording the options of the index in the binary format.
+const (
+	flagSkipEmpty = 1 << iota
+	flagAutoIndex
+	flagSignatures
+	flagReplaceDuplicateKeys
+	flagRejectDuplicateKeys
+	flagHashedKeys
+	flagCoalesce
+	flagBandSeeds
+	flagSignatureSeed
+	flagPadLeftover
+	flagRejectLeftover
+)
+
+// Type tags of the keys encoded by the default key codec.
+const (
+	keyTypeString = iota
+	keyTypeInt
+)
+
+// encodeDefaultKey encodes string and int keys.
+func encodeDefaultKey(key interface{}) ([]byte, error) {
+	switch v := key.(type) {
+	case string:
+		return append([]byte{keyTypeString}, v...), nil
+	case int:
+		b := make([]byte, 1+binary.MaxVarintLen64)
+		b[0] = keyTypeInt
+		n := binary.PutVarint(b[1:], int64(v))
+		return b[:1+n], nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T, only string and int keys can be serialized", key)
+	}
+}
+
+// decodeDefaultKey decodes keys encoded by encodeDefaultKey.
+func decodeDefaultKey(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, errors.New("Empty encoded key")
+	}
+	switch b[0] {
+	case keyTypeString:
+		return string(b[1:]), nil
+	case keyTypeInt:
+		v, n := binary.Varint(b[1:])
+		if n <= 0 {
+			return nil, errors.New("Incorrect encoded int key")
+		}
+		return int(v), nil
+	default:
+		return nil, fmt.Errorf("Unknown key type %d", b[0])
+	}
+}
+
+// MarshalBinary encodes the index, including its parameters, hash tables
+// and stored signatures, into a byte slice.
+// Only string and int keys are supported.
+func (f *MinhashLSH) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := f.encode(&buf, encodeDefaultKey); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an index encoded by MarshalBinary,
+// replacing the content of f.
+func (f *MinhashLSH) UnmarshalBinary(data []byte) error {
+	return f.decode(bytes.NewReader(data), int64(len(data)), decodeDefaultKey)
+}
+
+// Save writes the index to w in the format of MarshalBinary, using
+// encodeKey to encode the keys so keys of any type can be saved.
+// If encodeKey is nil, the default codec supporting only string and
+// int keys is used.
+func (f *MinhashLSH) Save(w io.Writer, encodeKey func(interface{}) ([]byte, error)) error {
+	if encodeKey == nil {
+		encodeKey = encodeDefaultKey
+	}
+	return f.encode(w, encodeKey)
+}
+
+// Load reads an index written by Save from r. decodeKey must be the
+// inverse of the encodeKey given to Save, and if it is nil the default
+// codec supporting only string and int keys is used.
+func Load(r io.Reader, decodeKey func([]byte) (interface{}, error)) (*MinhashLSH, error) {
+	if decodeKey == nil {
+		decodeKey = decodeDefaultKey
+	}
+	size := int64(-1)
+	if lr, ok := r.(interface {
+		Len() int
+	}); ok {
+		size = int64(lr.Len())
+	}
+	f := new(MinhashLSH)
+	if err := f.decode(r, size, decodeKey); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// encode writes the index to w, every distinct key is encoded once
+// using encodeKey, and hash table entries refer to keys by position.
+func (f *MinhashLSH) encode(w io.Writer, encodeKey func(interface{}) ([]byte, error)) error {
+	bw := &binaryWriter{w: w}
+	bw.write([]byte(binaryMagic))
+	bw.write([]byte{binaryVersion})
+	bw.writeUvarint(uint64(f.k))
+	bw.writeUvarint(uint64(f.l))
+	bw.writeUvarint(uint64(f.numHash))
+	bw.writeUvarint(uint64(f.hashValueSize))
+	bw.writeUint64(math.Float64bits(f.threshold))
+	var flags uint64
+	if f.skipEmpty {
+		flags |= flagSkipEmpty
+	}
+	if f.autoIndex {
+		flags |= flagAutoIndex
+	}
+	if f.signatures != nil {
+		flags |= flagSignatures
+	}
+	if f.hashedKeys {
+		flags |= flagHashedKeys
+	}
+	if f.coalesce {
+		flags |= flagCoalesce
+	}
+	if f.bandSeeds != nil {
+		flags |= flagBandSeeds
+	}
+	if f.hasSigSeed {
+		flags |= flagSignatureSeed
+	}
+	switch f.leftover {
+	case PadLeftoverHashValues:
+		flags |= flagPadLeftover
+	case RejectLeftoverHashValues:
+		flags |= flagRejectLeftover
+	}
+	switch f.duplicatePolicy {
+	case ReplaceDuplicateKeys:
+		flags |= flagReplaceDuplicateKeys
+	case RejectDuplicateKeys:
+		flags |= flagRejectDuplicateKeys
+	}
+	bw.writeUvarint(flags)
+	bw.writeUvarint(uint64(f.numIndexedKeys))
+	if f.bandSeeds != nil {
+		bw.writeUint64(uint64(f.bandSeed))
+	}
+	if f.hasSigSeed {
+		bw.writeUint64(uint64(f.sigSeed))
+	}
+
+	// Collect the distinct keys.
+	keyIndexes := make(map[interface{}]uint64)
+	var keys []interface{}
+	addKey := func(key interface{}) {
+		if _, exist := keyIndexes[key]; !exist {
+			keyIndexes[key] = uint64(len(keys))
+			keys = append(keys, key)
+		}
+	}
+	for _, table := range f.hashTables {
+		for _, e := range table {
+			addKey(e.key)
+		}
+	}
+	for key := range f.signatures {
+		addKey(key)
+	}
+	for alias := range f.aliasOf {
+		addKey(alias)
+	}
+	bw.writeUvarint(uint64(len(keys)))
+	for _, key := range keys {
+		b, err := encodeKey(key)
+		if err != nil {
+			return err
+		}
+		bw.writeUvarint(uint64(len(b)))
+		bw.write(b)
+	}
+
+	for _, table := range f.hashTables {
+		bw.writeUvarint(uint64(len(table)))
+		for _, e := range table {
+			bw.write([]byte(e.hashKey))
+			bw.writeUvarint(keyIndexes[e.key])
+		}
+	}
+
+	if f.signatures != nil {
+		bw.writeUvarint(uint64(len(f.signatures)))
+		for key, sig := range f.signatures {
+			bw.writeUvarint(keyIndexes[key])
+			bw.writeUvarint(uint64(len(sig)))
+			for _, v := range sig {
+				bw.writeUint64(v)
+			}
+		}
+	}
+
+	if f.coalesce {
+		bw.writeUvarint(uint64(len(f.aliasOf)))
+		for alias, key := range f.aliasOf {
+			bw.writeUvarint(keyIndexes[alias])
+			bw.writeUvarint(keyIndexes[key])
+		}
+	}
+	return bw.err
+}
+
+// decode reads an index written by encode from r, replacing the content
+// of f. decodeKey must be the inverse of the encodeKey used. size is the
+// number of bytes left in r, or negative if unknown. The lengths and
+// counts read are checked against it before anything is allocated for
+// them, and with an unknown size, memory is only allocated as the data
+// is read, so a corrupted input is an error rather than an allocation
+// failure.
+func (f *MinhashLSH) decode(r io.Reader, size int64, decodeKey func([]byte) (interface{}, error)) error {
+	br := newBinaryReader(toByteReader(r), size)
+	version, k64, l64, numHash64, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+	hashValueSize64 := br.readUvarint()
+	threshold := math.Float64frombits(br.readUint64())
+	var flags uint64
+	if version == 1 {
+		flags = uint64(br.readByte())
+	} else {
+		flags = br.readUvarint()
+	}
+	numIndexedKeys := br.readUvarint()
+	var bandSeed, sigSeed int64
+	if flags&flagBandSeeds != 0 {
+		bandSeed = int64(br.readUint64())
+	}
+	if flags&flagSignatureSeed != 0 {
+		sigSeed = int64(br.readUint64())
+	}
+	if br.err != nil {
+		return br.err
+	}
+	// The bands cannot have more hash values than the signatures.
+	if numHash64 > math.MaxInt32 || k64 < 1 || k64 > numHash64 || l64 < 1 || l64 > numHash64 ||
+		hashValueSize64 < 1 || hashValueSize64 > 8 {
+		return errors.New("Incorrect MinhashLSH parameters")
+	}
+	k, l, numHash, hashValueSize := int(k64), int(l64), int(numHash64), int(hashValueSize64)
+	// Only the last band, of PadLeftoverHashValues, can be short.
+	if k*l > numHash && k*(l-1) >= numHash {
+		return errors.New("Incorrect MinhashLSH parameters")
+	}
+	// Every band has at least the uvarint number of its entries.
+	br.expect(uint64(l), 1)
+
+	// Every key has at least the uvarint length of its encoding.
+	numKeys := br.readUvarint()
+	br.expect(numKeys, 1)
+	keys := make([]interface{}, 0, br.capacity(numKeys))
+	for i := uint64(0); i < numKeys && br.err == nil; i++ {
+		b := br.read(int(br.readUvarint()))
+		if br.err != nil {
+			break
+		}
+		key, err := decodeKey(b)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	keyAt := func(i uint64) interface{} {
+		if i >= uint64(len(keys)) {
+			br.fail(errors.New("Incorrect key reference"))
+			return nil
+		}
+		return keys[i]
+	}
+
+	hashKeySize := k * hashValueSize
+	hashKeyFunc := hashKeyFuncGen(hashValueSize)
+	if flags&flagHashedKeys != 0 {
+		hashKeySize = 8
+		hashKeyFunc = hashedKeyFuncGen(hashValueSize)
+	}
+	hashTables := make([]hashTable, 0, br.capacity(uint64(l)))
+	for i := 0; i < l; i++ {
+		n := br.readUvarint()
+		if br.err != nil {
+			return br.err
+		}
+		if n < numIndexedKeys {
+			return errors.New("Incorrect number of hash table entries")
+		}
+		// Every entry has its hash key and the uvarint position of its key.
+		if !br.expect(n, uint64(hashKeySize)+1) {
+			return br.err
+		}
+		table := make(hashTable, 0, br.capacity(n))
+		for j := uint64(0); j < n && br.err == nil; j++ {
+			hashKey := string(br.read(hashKeySize))
+			key := keyAt(br.readUvarint())
+			table = append(table, entry{hashKey, key})
+		}
+		hashTables = append(hashTables, table)
+	}
+
+	var signatures map[interface{}][]uint64
+	if flags&flagSignatures != 0 {
+		signatures = make(map[interface{}][]uint64)
+		// Every signature has the uvarint position of its key and length.
+		n := br.readUvarint()
+		br.expect(n, uint64(2+8*numHash))
+		for i := uint64(0); i < n && br.err == nil; i++ {
+			key := keyAt(br.readUvarint())
+			size := br.readUvarint()
+			if br.err == nil && size != numHash64 {
+				br.fail(fmt.Errorf("Incorrect signature length %d of key %v", size, key))
+			}
+			if !br.expect(size, 8) {
+				break
+			}
+			sig := make([]uint64, 0, br.capacity(size))
+			for j := uint64(0); j < size && br.err == nil; j++ {
+				sig = append(sig, br.readUint64())
+			}
+			signatures[key] = sig
+		}
+	}
+
+	aliasOf := make(map[interface{}]interface{})
+	if flags&flagCoalesce != 0 {
+		// Every alias has the uvarint positions of the alias and its key.
+		n := br.readUvarint()
+		br.expect(n, 2)
+		for i := uint64(0); i < n && br.err == nil; i++ {
+			alias := keyAt(br.readUvarint())
+			aliasOf[alias] = keyAt(br.readUvarint())
+		}
+	}
+	if br.err != nil {
+		return br.err
+	}
+
+	keyMembers, ok := members(hashTables)
+	if !ok {
+		return errors.New("Incorrect hash table entries")
+	}
+	for alias, key := range aliasOf {
+		_, aliasIndexed := keyMembers[alias]
+		if _, exist := keyMembers[key]; !exist || aliasIndexed {
+			return errors.New("Incorrect alias reference")
+		}
+	}
+	leftover := DropLeftoverHashValues
+	if flags&flagPadLeftover != 0 {
+		leftover = PadLeftoverHashValues
+	} else if flags&flagRejectLeftover != 0 {
+		leftover = RejectLeftoverHashValues
+	}
+	duplicatePolicy := AllowDuplicateKeys
+	if flags&flagReplaceDuplicateKeys != 0 {
+		duplicatePolicy = ReplaceDuplicateKeys
+	} else if flags&flagRejectDuplicateKeys != 0 {
+		duplicatePolicy = RejectDuplicateKeys
+	}
+
+	*f = MinhashLSH{
+		k:               k,
+		l:               l,
+		numHash:         numHash,
+		threshold:       threshold,
+		hashTables:      hashTables,
+		hashKeyFunc:     hashKeyFunc,
+		hashValueSize:   hashValueSize,
+		hashedKeys:      flags&flagHashedKeys != 0,
+		numIndexedKeys:  int(numIndexedKeys),
+		locks:           make([]sync.Mutex, l),
+		members:         keyMembers,
+		signatures:      signatures,
+		skipEmpty:       flags&flagSkipEmpty != 0,
+		autoIndex:       flags&flagAutoIndex != 0,
+		duplicatePolicy: duplicatePolicy,
+		leftover:        leftover,
+	}
+	if flags&flagBandSeeds != 0 {
+		BandSeeds(bandSeed)(f)
+	}
+	if flags&flagSignatureSeed != 0 {
+		SignatureSeed(sigSeed)(f)
+	}
+	if flags&flagCoalesce != 0 {
+		CoalesceIdenticalSignatures()(f)
+		f.rebuildSigOwners()
+		for alias, key := range aliasOf {
+			f.aliasOf[alias] = key
+			f.aliases[key] = append(f.aliases[key], alias)
+		}
+	}
+	return nil
+}
+
+// readHeader reads the format version and the parameters k, l and
+// numHash at the start of an index written by encode.
+func readHeader(br *binaryReader) (version byte, k, l, numHash uint64, err error) {
+	magic := br.read(len(binaryMagic) + 1)
+	if br.err != nil {
+		return 0, 0, 0, 0, br.err
+	}
+	if string(magic[:len(binaryMagic)]) != binaryMagic {
+		return 0, 0, 0, 0, errors.New("Incorrect MinhashLSH binary format")
+	}
+	version = magic[len(binaryMagic)]
+	if version < 1 || version > binaryVersion {
+		return 0, 0, 0, 0, fmt.Errorf("Unsupported MinhashLSH binary format version %d", version)
+	}
+	k, l, numHash = br.readUvarint(), br.readUvarint(), br.readUvarint()
+	return version, k, l, numHash, br.err
+}
+
+// members reconstructs the hash keys of every key in the hash tables,
+// in the layout of MinhashLSH.members. It returns false if a key does
+// not have the same number of entries in every band.
+func members(hashTables []hashTable) (map[interface{}][]string, bool) {
+	// The hash keys of every key in every band.
+	bands := make(map[interface{}][][]string)
+	for i, table := range hashTables {
+		for _, e := range table {
+			if _, exist := bands[e.key]; !exist {
+				bands[e.key] = make([][]string, len(hashTables))
+			}
+			bands[e.key][i] = append(bands[e.key][i], e.hashKey)
+		}
+	}
+	m := make(map[interface{}][]string, len(bands))
+	for key, hashKeys := range bands {
+		for i := range hashKeys {
+			if len(hashKeys[i]) != len(hashKeys[0]) {
+				return nil, false
+			}
+		}
+		for j := range hashKeys[0] {
+			for i := range hashKeys {
+				m[key] = append(m[key], hashKeys[i][j])
+			}
+		}
+	}
+	return m, true
+}
+
+// binaryWriter writes binary encoded values and keeps the first error.
+type binaryWriter struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (bw *binaryWriter) write(b []byte) {
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(b)
+	}
+}
+
+func (bw *binaryWriter) writeUvarint(v uint64) {
+	n := binary.PutUvarint(bw.buf[:], v)
+	bw.write(bw.buf[:n])
+}
+
+func (bw *binaryWriter) writeUint64(v uint64) {
+	binary.LittleEndian.PutUint64(bw.buf[:8], v)
+	bw.write(bw.buf[:8])
+}
+
+// byteReader is an io.Reader that can also read single bytes,
+// as required by binary.ReadUvarint.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func toByteReader(r io.Reader) byteReader {
+	if br, ok := r.(byteReader); ok {
+		return br
+	}
+	return &singleByteReader{Reader: r}
+}
+
+// singleByteReader adds ReadByte to an io.Reader without buffering,
+// so no more than the encoded index is consumed from the reader.
+type singleByteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *singleByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(r.Reader, r.b[:])
+	return r.b[0], err
+}
+
+// The largest length read at once, longer ones are read in chunks, so a
+// corrupted length of an input of unknown size is only allocated as far
+// as the input goes.
+const readChunkSize = 64 * 1024
+
+// binaryReader reads binary encoded values and keeps the first error.
+type binaryReader struct {
+	r   byteReader
+	err error
+	// remaining is the number of bytes left in the input, or negative if
+	// unknown.
+	remaining int64
+}
+
+func newBinaryReader(r byteReader, size int64) *binaryReader {
+	return &binaryReader{r: r, remaining: size}
+}
+
+// expect fails if the input is known to have fewer bytes left than n
+// values of size bytes each, and returns whether there was no error.
+func (br *binaryReader) expect(n, size uint64) bool {
+	if br.err == nil && br.remaining >= 0 && size > 0 && n > uint64(br.remaining)/size {
+		br.fail(errors.New("Incorrect length, longer than the input"))
+	}
+	return br.err == nil
+}
+
+// capacity returns the capacity to allocate for n values whose length
+// was checked by expect, which is at most readChunkSize values if the
+// size of the input is unknown, and none after an error.
+func (br *binaryReader) capacity(n uint64) int {
+	if br.err != nil {
+		return 0
+	}
+	if br.remaining < 0 && n > readChunkSize {
+		return readChunkSize
+	}
+	return int(n)
+}
+
+// consume records that n bytes of the input were read.
+func (br *binaryReader) consume(n int) {
+	if br.remaining >= 0 {
+		br.remaining -= int64(n)
+	}
+}
+
+func (br *binaryReader) fail(err error) {
+	if br.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		br.err = err
+	}
+}
+
+func (br *binaryReader) read(n int) []byte {
+	if br.err != nil {
+		return nil
+	}
+	if n < 0 {
+		br.fail(errors.New("Incorrect length"))
+		return nil
+	}
+	if !br.expect(uint64(n), 1) {
+		return nil
+	}
+	if n > readChunkSize && br.remaining < 0 {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, br.r, int64(n)); err != nil {
+			br.fail(err)
+			return nil
+		}
+		return buf.Bytes()
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br.r, b); err != nil {
+		br.fail(err)
+		return nil
+	}
+	br.consume(n)
+	return b
+}
+
+func (br *binaryReader) readByte() byte {
+	if br.err != nil {
+		return 0
+	}
+	b, err := br.r.ReadByte()
+	if err != nil {
+		br.fail(err)
+	}
+	br.consume(1)
+	return b
+}
+
+func (br *binaryReader) readUvarint() uint64 {
+	if br.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		br.fail(err)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	br.consume(binary.PutUvarint(buf[:], v))
+	return v
+}
+
+func (br *binaryReader) readUint64() uint64 {
+	b := br.read(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
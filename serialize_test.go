@@ -0,0 +1,210 @@
+package minhashlsh
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_MinhashLSHMarshalBinary(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 4, StoreSignatures())
+	sig1 := randomSignature(256, 1)
+	sig2 := randomSignature(256, 2)
+	f.Add("sig1", sig1)
+	f.Add(2, sig2)
+	f.Add("sig3", sig2)
+	f.Index()
+	// Not indexed yet.
+	f.Add("sig4", sig2)
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g MinhashLSH
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	k, l := g.Params()
+	if expectedK, expectedL := f.Params(); k != expectedK || l != expectedL {
+		t.Fatalf("expected k = %d, l = %d, got k = %d, l = %d", expectedK, expectedL, k, l)
+	}
+	if g.threshold != f.threshold || g.numHash != f.numHash {
+		t.Fatal("parameters not preserved")
+	}
+	if len(g.Query(sig1)) != 1 {
+		t.Fatal("unable to retrieve key after round trip")
+	}
+	results := g.QueryDetailed(sig2)
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	for _, r := range results {
+		if r.Key != 2 && r.Key != "sig3" {
+			t.Fatal(r.Key)
+		}
+		if r.Similarity != 1.0 {
+			t.Fatal("stored signatures not preserved")
+		}
+	}
+	// Keys added but not indexed are preserved.
+	g.Index()
+	if len(g.Query(sig2)) != 3 {
+		t.Fatal("unable to retrieve key added before marshaling")
+	}
+
+	if err := g.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Fatal("expected error for truncated data")
+	}
+	if err := g.UnmarshalBinary([]byte("nope")); err == nil {
+		t.Fatal("expected error for incorrect data")
+	}
+}
+
+func Test_MinhashLSHMarshalBinaryUnsupportedKey(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 1)
+	f.Add(1.5, randomSignature(256, 1))
+	f.Index()
+	if _, err := f.MarshalBinary(); err == nil {
+		t.Fatal("expected error for unsupported key type")
+	}
+}
+
+type docKey struct {
+	Collection string
+	ID         string
+}
+
+func Test_MinhashLSHSaveLoadKeyCodec(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2)
+	sig1 := randomSignature(256, 1)
+	sig2 := randomSignature(256, 2)
+	f.Add(docKey{"web", "a"}, sig1)
+	f.Add(docKey{"web", "b"}, sig2)
+	f.Index()
+
+	encodeKey := func(key interface{}) ([]byte, error) {
+		k := key.(docKey)
+		return []byte(k.Collection + "/" + k.ID), nil
+	}
+	decodeKey := func(b []byte) (interface{}, error) {
+		parts := strings.SplitN(string(b), "/", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("incorrect key")
+		}
+		return docKey{parts[0], parts[1]}, nil
+	}
+	var buf bytes.Buffer
+	if err := f.Save(&buf, encodeKey); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(&buf, decodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := g.Query(sig2)
+	if len(results) != 1 || results[0] != (docKey{"web", "b"}) {
+		t.Fatal(results)
+	}
+
+	// Struct keys are not supported by the default codec.
+	if err := f.Save(&buf, nil); err == nil {
+		t.Fatal("expected error for unsupported key type")
+	}
+}
+
+func Test_MinhashLSHSaveLoadDefaultCodec(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2)
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	f.Add(2, randomSignature(256, 2))
+	f.Index()
+	var buf bytes.Buffer
+	if err := f.Save(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig); len(results) != 1 || results[0] != "sig1" {
+		t.Fatal(results)
+	}
+}
+
+func Test_MinhashLSHUnmarshalBinaryVersion1(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 2, StoreSignatures())
+	sig := randomSignature(256, 1)
+	f.Add("sig1", sig)
+	f.Index()
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With fewer than 8 flags, the uvarint flags of version 2 are the
+	// single flags byte of version 1.
+	data[len(binaryMagic)] = 1
+	var g MinhashLSH
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if results := g.Query(sig); len(results) != 1 {
+		t.Fatal(results)
+	}
+	data[len(binaryMagic)] = binaryVersion + 1
+	if err := g.UnmarshalBinary(data); err == nil {
+		t.Fatal("expected error for unsupported version")
+	}
+}
+
+func Test_MinhashLSHUnmarshalBinaryCorrupted(t *testing.T) {
+	header := func(k, l, numHash uint64) *bytes.Buffer {
+		var buf bytes.Buffer
+		bw := &binaryWriter{w: &buf}
+		bw.write([]byte(binaryMagic))
+		bw.write([]byte{binaryVersion})
+		bw.writeUvarint(k)
+		bw.writeUvarint(l)
+		bw.writeUvarint(numHash)
+		bw.writeUvarint(2)
+		bw.writeUint64(0)
+		bw.writeUvarint(0)
+		bw.writeUvarint(0)
+		return &buf
+	}
+	// Loaded both from a byte slice, of known size, and from a reader of
+	// unknown size, none of them must allocate the lengths.
+	check := func(name string, data []byte) {
+		var g MinhashLSH
+		if err := g.UnmarshalBinary(data); err == nil {
+			t.Fatalf("expected error for %s", name)
+		}
+		if _, err := Load(struct{ io.Reader }{bytes.NewReader(data)}, nil); err == nil {
+			t.Fatalf("expected error for %s of unknown size", name)
+		}
+	}
+	check("too many hash values", header(1, 1, 1<<40).Bytes())
+	check("too many bands", header(1, 1<<30, 1<<30).Bytes())
+	buf := header(1, 1, 1)
+	bw := &binaryWriter{w: buf}
+	bw.writeUvarint(1)
+	bw.writeUvarint(1 << 50)
+	check("too long key", buf.Bytes())
+	buf = header(1, 1, 1)
+	bw = &binaryWriter{w: buf}
+	bw.writeUvarint(0)
+	bw.writeUvarint(1 << 40)
+	check("too many entries", buf.Bytes())
+
+	f := NewMinhashLSH16(256, 0.6, 1, StoreSignatures())
+	f.Add("sig1", randomSignature(256, 1))
+	f.Index()
+	f.signatures["sig1"] = f.signatures["sig1"][:255]
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("incorrect signature length", data)
+}
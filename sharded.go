@@ -0,0 +1,48 @@
+package minhashlsh
+
+import "sync"
+
+// MergeQueryResults returns the union of the candidate keys returned by
+// querying several indexes, with every key appearing once.
+func MergeQueryResults(results ...[]interface{}) []interface{} {
+	set := make(map[interface{}]int)
+	for _, result := range results {
+		for _, key := range result {
+			set[key]++
+		}
+	}
+	return keys(set)
+}
+
+// ShardedLSH queries a set of MinhashLSH indexes, each holding a shard
+// of the keys, as a single index. The shards must be created with the
+// same parameters, and the keys must be distributed by the caller.
+type ShardedLSH struct {
+	shards []*MinhashLSH
+}
+
+// NewShardedLSH creates a ShardedLSH over the given shards.
+func NewShardedLSH(shards ...*MinhashLSH) *ShardedLSH {
+	return &ShardedLSH{shards: shards}
+}
+
+// Shards returns the shards of the index.
+func (s *ShardedLSH) Shards() []*MinhashLSH {
+	return s.shards
+}
+
+// Query queries all shards in parallel and returns the union of the
+// candidate keys.
+func (s *ShardedLSH) Query(sig []uint64) []interface{} {
+	results := make([][]interface{}, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		wg.Add(1)
+		go func(i int, shard *MinhashLSH) {
+			defer wg.Done()
+			results[i] = shard.Query(sig)
+		}(i, shard)
+	}
+	wg.Wait()
+	return MergeQueryResults(results...)
+}
@@ -0,0 +1,50 @@
+package minhashlsh
+
+import (
+	"sort"
+	"testing"
+)
+
+func Test_MergeQueryResults(t *testing.T) {
+	merged := MergeQueryResults([]interface{}{"a", "b"}, nil, []interface{}{"b", "c"})
+	var results []string
+	for _, key := range merged {
+		results = append(results, key.(string))
+	}
+	sort.Strings(results)
+	if len(results) != 3 || results[0] != "a" || results[1] != "b" || results[2] != "c" {
+		t.Fatal(results)
+	}
+}
+
+func Test_ShardedLSHQuery(t *testing.T) {
+	shards := []*MinhashLSH{
+		NewMinhashLSH16(256, 0.6, 2),
+		NewMinhashLSH16(256, 0.6, 2),
+	}
+	sig := randomSignature(256, 1)
+	for i, key := range []string{"sig1", "sig2", "sig3"} {
+		shard := shards[i%len(shards)]
+		if key == "sig3" {
+			shard.Add(key, randomSignature(256, 2))
+		} else {
+			shard.Add(key, sig)
+		}
+	}
+	// The same key in two shards is returned once.
+	shards[1].Add("sig1", sig)
+	for _, shard := range shards {
+		shard.Index()
+	}
+
+	s := NewShardedLSH(shards...)
+	results := s.Query(sig)
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	for _, key := range results {
+		if key != "sig1" && key != "sig2" {
+			t.Fatal(results)
+		}
+	}
+}
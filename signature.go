@@ -0,0 +1,390 @@
+package minhashlsh
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrSignatureLength is returned when signatures that must have
+// the same length do not, or are empty.
+var ErrSignatureLength = errors.New("Signatures must be non-empty and have the same length")
+
+// putSigValues writes the lowest width bytes of every hash value of sig
+// into b in little endian order, b must have length len(sig)*width.
+func putSigValues(b []byte, sig []uint64, width int) {
+	if width == 8 {
+		for i, v := range sig {
+			binary.LittleEndian.PutUint64(b[i*8:], v)
+		}
+		return
+	}
+	for i, v := range sig {
+		for j := 0; j < width; j++ {
+			b[i*width+j] = byte(v >> (8 * uint(j)))
+		}
+	}
+}
+
+func checkWidth(width int) error {
+	if width < 1 || width > 8 {
+		return fmt.Errorf("Unsupported hash value width %d, must be between 1 and 8 bytes", width)
+	}
+	return nil
+}
+
+// SigToBytes serializes the signature into a byte slice using
+// 8 bytes in little endian order for every hash value.
+func SigToBytes(sig []uint64) []byte {
+	b, _ := SigToBytesWidth(sig, hashValueSize)
+	return b
+}
+
+// BytesToSig deserializes a signature serialized by SigToBytes.
+func BytesToSig(b []byte) ([]uint64, error) {
+	return BytesToSigWidth(b, hashValueSize)
+}
+
+// SigToBytesWidth serializes the signature into a byte slice using
+// width bytes in little endian order for every hash value, hash values
+// are truncated to their lowest width bytes. The width must be between
+// 1 and 8, SigToBytesWidth(sig, 8) is the same as SigToBytes(sig).
+func SigToBytesWidth(sig []uint64, width int) ([]byte, error) {
+	if err := checkWidth(width); err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(sig)*width)
+	putSigValues(b, sig, width)
+	return b, nil
+}
+
+// BytesToSigWidth deserializes a signature serialized by SigToBytesWidth
+// with the same width. It returns an error if the length of b is not a
+// multiple of width.
+func BytesToSigWidth(b []byte, width int) ([]uint64, error) {
+	if err := checkWidth(width); err != nil {
+		return nil, err
+	}
+	if len(b)%width != 0 {
+		return nil, fmt.Errorf("Length %d is not a multiple of the hash value width %d", len(b), width)
+	}
+	sig := make([]uint64, len(b)/width)
+	if width == 8 {
+		for i := range sig {
+			sig[i] = binary.LittleEndian.Uint64(b[i*8:])
+		}
+		return sig, nil
+	}
+	for i := range sig {
+		var v uint64
+		for j := width - 1; j >= 0; j-- {
+			v = v<<8 | uint64(b[i*width+j])
+		}
+		sig[i] = v
+	}
+	return sig, nil
+}
+
+// SigToBBit packs the lowest b bits of every hash value of the signature
+// into a byte slice, least significant bit first, for b-bit MinHash
+// signatures that take b bits instead of 64 per hash value.
+// The b must be between 1 and 64.
+func SigToBBit(sig []uint64, b int) ([]byte, error) {
+	if err := checkBits(b); err != nil {
+		return nil, err
+	}
+	packed := make([]byte, bbitSize(len(sig), b))
+	for i, v := range sig {
+		for j := 0; j < b; j++ {
+			if v&(1<<uint(j)) != 0 {
+				bit := i*b + j
+				packed[bit/8] |= 1 << uint(bit%8)
+			}
+		}
+	}
+	return packed, nil
+}
+
+func checkBits(b int) error {
+	if b < 1 || b > 64 {
+		return fmt.Errorf("Unsupported number of bits %d, must be between 1 and 64", b)
+	}
+	return nil
+}
+
+// bbitSize returns the number of bytes of numHash packed b-bit values.
+func bbitSize(numHash, b int) int {
+	return (numHash*b + 7) / 8
+}
+
+// bbitValue returns the i-th b-bit value of a signature packed by SigToBBit.
+func bbitValue(packed []byte, i, b int) uint64 {
+	var v uint64
+	for j := 0; j < b; j++ {
+		bit := i*b + j
+		if packed[bit/8]&(1<<uint(bit%8)) != 0 {
+			v |= 1 << uint(j)
+		}
+	}
+	return v
+}
+
+// EstimateJaccardBBit returns the estimated Jaccard similarity of the sets
+// represented by two b-bit signatures of numHash hash values packed by
+// SigToBBit. Two different hash values still have equal lowest b bits
+// with probability 1/2^b, so the fraction of matching b-bit values p is
+// biased upwards, and the estimate is corrected to (p-1/2^b)/(1-1/2^b),
+// clamped to [0, 1]. The correction assumes the sets are small compared
+// to the universe of hash values, which holds for 64-bit hash values.
+// Fewer bits make the estimate noisier, so b-bit signatures need more
+// hash values for the same accuracy.
+func EstimateJaccardBBit(sig1, sig2 []byte, b, numHash int) (float64, error) {
+	if err := checkBits(b); err != nil {
+		return 0, err
+	}
+	if numHash < 1 || len(sig1) != bbitSize(numHash, b) || len(sig2) != len(sig1) {
+		return 0, ErrSignatureLength
+	}
+	var matches int
+	for i := 0; i < numHash; i++ {
+		if bbitValue(sig1, i, b) == bbitValue(sig2, i, b) {
+			matches++
+		}
+	}
+	return BBitEstimator{b}.Estimate(matches, numHash), nil
+}
+
+// SimilarityEstimator estimates the Jaccard similarity of two sets from
+// the number of matching hash values of their signatures of numHash hash
+// values. A custom estimator can be given to the index by the Estimator
+// option, e.g. to correct the bias of small or b-bit signatures.
+type SimilarityEstimator interface {
+	Estimate(matches, numHash int) float64
+}
+
+// MatchFraction is the default SimilarityEstimator, which estimates the
+// similarity as matches/numHash, an unbiased estimate for signatures of
+// full hash values.
+type MatchFraction struct{}
+
+// Estimate returns matches/numHash.
+func (MatchFraction) Estimate(matches, numHash int) float64 {
+	return float64(matches) / float64(numHash)
+}
+
+// BBitEstimator is the SimilarityEstimator of signatures keeping only
+// the lowest B bits of every hash value, as used by EstimateJaccardBBit.
+type BBitEstimator struct {
+	B int
+}
+
+// Estimate returns the fraction of matching hash values corrected for
+// the probability 1/2^B of different hash values matching, clamped to
+// [0, 1].
+func (e BBitEstimator) Estimate(matches, numHash int) float64 {
+	p := float64(matches) / float64(numHash)
+	c := math.Ldexp(1, -e.B)
+	return math.Max(0, math.Min(1, (p-c)/(1-c)))
+}
+
+// SigToHex encodes the signature as a hexadecimal string of the bytes
+// returned by SigToBytes.
+func SigToHex(sig []uint64) string {
+	return hex.EncodeToString(SigToBytes(sig))
+}
+
+// HexToSig decodes a signature encoded by SigToHex. It returns an error
+// if s is not hexadecimal or does not encode whole hash values.
+func HexToSig(s string) ([]uint64, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return BytesToSig(b)
+}
+
+// SigMatches returns the number of positions at which the hash values
+// of the two signatures are equal.
+func SigMatches(sig1, sig2 []uint64) (int, error) {
+	if len(sig1) != len(sig2) || len(sig1) == 0 {
+		return 0, ErrSignatureLength
+	}
+	var matches int
+	for i := range sig1 {
+		if sig1[i] == sig2[i] {
+			matches++
+		}
+	}
+	return matches, nil
+}
+
+// SigMatchMask returns for every position whether the hash values of
+// the two signatures are equal, and the number of such positions,
+// which is the same as returned by SigMatches.
+func SigMatchMask(sig1, sig2 []uint64) (mask []bool, matches int, err error) {
+	if len(sig1) != len(sig2) || len(sig1) == 0 {
+		return nil, 0, ErrSignatureLength
+	}
+	mask = make([]bool, len(sig1))
+	for i := range sig1 {
+		if sig1[i] == sig2[i] {
+			mask[i] = true
+			matches++
+		}
+	}
+	return mask, matches, nil
+}
+
+// EstimateJaccard returns the estimated Jaccard similarity of the sets
+// represented by the two signatures, which is the fraction of positions
+// at which the hash values are equal.
+func EstimateJaccard(sig1, sig2 []uint64) (float64, error) {
+	matches, err := SigMatches(sig1, sig2)
+	if err != nil {
+		return 0, err
+	}
+	return float64(matches) / float64(len(sig1)), nil
+}
+
+// SimilarityMatrix returns the symmetric matrix of the estimated Jaccard
+// similarities of every pair of signatures, with ones on the diagonal.
+// It takes O(N^2 * numHash) time for N signatures, so it is meant for
+// small sets such as a candidate cluster found by the index.
+// All signatures must be non-empty and have the same length.
+func SimilarityMatrix(sigs [][]uint64) ([][]float64, error) {
+	for _, sig := range sigs {
+		if len(sig) == 0 || len(sig) != len(sigs[0]) {
+			return nil, ErrSignatureLength
+		}
+	}
+	matrix := make([][]float64, len(sigs))
+	for i := range matrix {
+		matrix[i] = make([]float64, len(sigs))
+		matrix[i][i] = 1
+		for j := 0; j < i; j++ {
+			matrix[i][j], _ = EstimateJaccard(sigs[i], sigs[j])
+			matrix[j][i] = matrix[i][j]
+		}
+	}
+	return matrix, nil
+}
+
+// SigsToColumnar transposes the signatures into columns, the i-th column
+// holding the i-th hash value of every signature in order, a layout that
+// compresses better as the values of a column are of the same hash
+// function. All signatures must be non-empty and have the same length.
+func SigsToColumnar(sigs [][]uint64) ([][]uint64, error) {
+	for _, sig := range sigs {
+		if len(sig) == 0 || len(sig) != len(sigs[0]) {
+			return nil, ErrSignatureLength
+		}
+	}
+	if len(sigs) == 0 {
+		return [][]uint64{}, nil
+	}
+	return transpose(sigs), nil
+}
+
+// ColumnarToSigs transposes columns created by SigsToColumnar back into
+// the signatures. All columns must be non-empty and have the same length.
+func ColumnarToSigs(columns [][]uint64) ([][]uint64, error) {
+	return SigsToColumnar(columns)
+}
+
+// transpose returns the transpose of the non-empty rectangular matrix.
+func transpose(matrix [][]uint64) [][]uint64 {
+	// A single backing array for all rows of the transpose.
+	values := make([]uint64, len(matrix)*len(matrix[0]))
+	t := make([][]uint64, len(matrix[0]))
+	for j := range t {
+		t[j] = values[j*len(matrix) : (j+1)*len(matrix)]
+		for i, row := range matrix {
+			t[j][i] = row[j]
+		}
+	}
+	return t
+}
+
+// EstimateJaccardCI returns the estimated Jaccard similarity of the sets
+// represented by the two signatures, and the lower and upper bounds of its
+// confidence interval for the z-score z (e.g. 1.96 for 95%).
+// Every position matches with probability equal to the Jaccard similarity,
+// so the number of matches is binomial, and the interval uses the normal
+// approximation estimate ± z*sqrt(estimate*(1-estimate)/numHash), clamped
+// to [0, 1]. The approximation is poor when the estimate is close to 0 or
+// 1, in particular the interval collapses to a single point at exactly 0
+// or 1, so it should be taken with care for extreme similarities or small
+// signatures.
+func EstimateJaccardCI(sig1, sig2 []uint64, z float64) (estimate, low, high float64, err error) {
+	estimate, err = EstimateJaccard(sig1, sig2)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	margin := z * math.Sqrt(estimate*(1-estimate)/float64(len(sig1)))
+	low = math.Max(0, estimate-margin)
+	high = math.Min(1, estimate+margin)
+	return estimate, low, high, nil
+}
+
+// MergeSignatures folds src into dst, setting every hash value of dst to
+// the minimum of the two, so dst becomes the signature of the union of
+// the sets. The signatures must be created with the same seed.
+func MergeSignatures(dst, src []uint64) error {
+	if len(dst) != len(src) || len(dst) == 0 {
+		return ErrSignatureLength
+	}
+	// Reslicing lets the compiler drop the bounds checks of the loop, and
+	// the minimums are stored unconditionally as the branch is hard to
+	// predict.
+	src = src[:len(dst)]
+	for i, v := range dst {
+		if w := src[i]; w < v {
+			v = w
+		}
+		dst[i] = v
+	}
+	return nil
+}
+
+// MergeWithProvenance returns the signature of the union of the sets
+// represented by the signatures, i.e. the element-wise minimum, and the
+// provenance of every position: provenance[i] is the index of the input
+// signature that contributed the minimum at position i. When several
+// inputs share the minimum, the one with the lowest index is chosen.
+// The signatures must be created with the same seed.
+func MergeWithProvenance(sigs ...[]uint64) (union []uint64, provenance []int, err error) {
+	if len(sigs) == 0 {
+		return nil, nil, ErrSignatureLength
+	}
+	for _, sig := range sigs {
+		if len(sig) != len(sigs[0]) || len(sig) == 0 {
+			return nil, nil, ErrSignatureLength
+		}
+	}
+	union = make([]uint64, len(sigs[0]))
+	copy(union, sigs[0])
+	provenance = make([]int, len(union))
+	for j, sig := range sigs[1:] {
+		for i, v := range sig {
+			if v < union[i] {
+				union[i] = v
+				provenance[i] = j + 1
+			}
+		}
+	}
+	return union, provenance, nil
+}
+
+// TruncateSignature returns a copy of the first newLen hash values of the
+// signature. Since the positions of a MinHash signature are independent,
+// the result is a valid signature of newLen hash functions, estimating
+// similarities with lower accuracy. It returns an error if newLen is not
+// between 1 and the length of the signature.
+func TruncateSignature(sig []uint64, newLen int) ([]uint64, error) {
+	if newLen < 1 || newLen > len(sig) {
+		return nil, fmt.Errorf("Cannot truncate signature of length %d to %d", len(sig), newLen)
+	}
+	return append([]uint64(nil), sig[:newLen]...), nil
+}
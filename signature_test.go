@@ -0,0 +1,333 @@
+package minhashlsh
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSigMatchMask(t *testing.T) {
+	sig1 := []uint64{1, 2, 3, 4}
+	sig2 := []uint64{1, 0, 3, 0}
+	mask, matches, err := SigMatchMask(sig1, sig2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bool{true, false, true, false}
+	for i := range expected {
+		if mask[i] != expected[i] {
+			t.Fatal(mask)
+		}
+	}
+	if count, _ := SigMatches(sig1, sig2); matches != count || matches != 2 {
+		t.Fatalf("expected 2 matches, got %d", matches)
+	}
+	if _, _, err := SigMatchMask(sig1, sig2[:2]); err != ErrSignatureLength {
+		t.Fatal("expected error for signatures of different lengths")
+	}
+}
+
+func TestEstimateJaccard(t *testing.T) {
+	sig1 := []uint64{1, 2, 3, 4}
+	sig2 := []uint64{1, 2, 0, 0}
+	j, err := EstimateJaccard(sig1, sig2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j != 0.5 {
+		t.Fatal(j)
+	}
+	if _, err := EstimateJaccard(sig1, sig2[:3]); err != ErrSignatureLength {
+		t.Fatal("expected error for signatures of different lengths")
+	}
+	if _, err := EstimateJaccard(nil, nil); err != ErrSignatureLength {
+		t.Fatal("expected error for empty signatures")
+	}
+}
+
+func TestSimilarityMatrix(t *testing.T) {
+	sigs := [][]uint64{
+		{1, 2, 3, 4},
+		{1, 2, 0, 0},
+		{0, 0, 0, 4},
+	}
+	matrix, err := SimilarityMatrix(sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]float64{
+		{1, 0.5, 0.25},
+		{0.5, 1, 0.25},
+		{0.25, 0.25, 1},
+	}
+	for i := range expected {
+		for j := range expected[i] {
+			if matrix[i][j] != expected[i][j] {
+				t.Fatal(matrix)
+			}
+		}
+	}
+	if _, err := SimilarityMatrix(append(sigs, []uint64{1})); err != ErrSignatureLength {
+		t.Fatal("expected error for signatures of different lengths")
+	}
+}
+
+func TestEstimateJaccardCI(t *testing.T) {
+	sig1 := randomSignature(100, 1)
+	sig2 := make([]uint64, len(sig1))
+	copy(sig2, sig1)
+	for i := 0; i < 20; i++ {
+		sig2[i] = 0
+	}
+	estimate, low, high, err := EstimateJaccardCI(sig1, sig2, 1.96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate != 0.8 {
+		t.Fatal(estimate)
+	}
+	margin := 1.96 * math.Sqrt(0.8*0.2/100)
+	if math.Abs(low-(0.8-margin)) > 1e-12 || math.Abs(high-(0.8+margin)) > 1e-12 {
+		t.Fatalf("unexpected interval [%f, %f]", low, high)
+	}
+
+	// Identical signatures have an interval of a single point.
+	estimate, low, high, err = EstimateJaccardCI(sig1, sig1, 1.96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate != 1 || low != 1 || high != 1 {
+		t.Fatalf("unexpected interval %f [%f, %f]", estimate, low, high)
+	}
+	if _, _, _, err := EstimateJaccardCI(sig1, sig2[:10], 1.96); err == nil {
+		t.Fatal("expected error for signatures of different lengths")
+	}
+}
+
+func TestMergeSignatures(t *testing.T) {
+	dst := []uint64{1, 5, 3, 7}
+	if err := MergeSignatures(dst, []uint64{2, 4, 3, 8}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint64{1, 4, 3, 7}
+	for i := range dst {
+		if dst[i] != expected[i] {
+			t.Fatal(dst)
+		}
+	}
+	if err := MergeSignatures(dst, dst[:3]); err != ErrSignatureLength {
+		t.Fatal("expected error for signatures of different lengths")
+	}
+}
+
+func TestMergeWithProvenance(t *testing.T) {
+	sig1 := []uint64{1, 5, 3, 7}
+	sig2 := []uint64{2, 4, 3, 8}
+	sig3 := []uint64{3, 6, 1, 9}
+	union, provenance, err := MergeWithProvenance(sig1, sig2, sig3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUnion := []uint64{1, 4, 1, 7}
+	expectedProvenance := []int{0, 1, 2, 0}
+	for i := range union {
+		if union[i] != expectedUnion[i] || provenance[i] != expectedProvenance[i] {
+			t.Fatalf("union %v, provenance %v", union, provenance)
+		}
+	}
+	if _, _, err := MergeWithProvenance(sig1, sig2[:3]); err != ErrSignatureLength {
+		t.Fatal("expected error for signatures of different lengths")
+	}
+	if _, _, err := MergeWithProvenance(); err != ErrSignatureLength {
+		t.Fatal("expected error for no signatures")
+	}
+}
+
+func TestSigToBytes(t *testing.T) {
+	sig := randomSignature(16, 1)
+	b := SigToBytes(sig)
+	if len(b) != 16*8 {
+		t.Fatal(len(b))
+	}
+	decoded, err := BytesToSig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sig {
+		if decoded[i] != sig[i] {
+			t.Fatal("signature changed after round trip")
+		}
+	}
+	if _, err := BytesToSig(b[:7]); err == nil {
+		t.Fatal("expected error for misaligned input")
+	}
+}
+
+func TestSigToBytesWidth4(t *testing.T) {
+	sig := []uint64{0x0102030405060708, 0xffffffff, 0}
+	b, err := SigToBytesWidth(sig, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{8, 7, 6, 5, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	if string(b) != string(expected) {
+		t.Fatal(b)
+	}
+	// The bytes of 4-byte values are a prefix of the 8-byte encoding.
+	b8 := SigToBytes(sig)
+	if string(b[:4]) != string(b8[:4]) {
+		t.Fatal("4-byte values should be truncated 8-byte values")
+	}
+	decoded, err := BytesToSigWidth(b, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sig {
+		if decoded[i] != sig[i]&0xffffffff {
+			t.Fatal(decoded)
+		}
+	}
+	if _, err := BytesToSigWidth(b[:5], 4); err == nil {
+		t.Fatal("expected error for misaligned input")
+	}
+	if _, err := SigToBytesWidth(sig, 9); err == nil {
+		t.Fatal("expected error for unsupported width")
+	}
+}
+
+func TestSigToBBit(t *testing.T) {
+	packed, err := SigToBBit([]uint64{1, 2, 3, 0xff}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 01, 10, 11, 11 packed least significant bit first.
+	if len(packed) != 1 || packed[0] != 0xf9 {
+		t.Fatalf("%x", packed)
+	}
+	if _, err := SigToBBit([]uint64{1}, 65); err == nil {
+		t.Fatal("expected error for unsupported number of bits")
+	}
+}
+
+func TestEstimateJaccardBBit(t *testing.T) {
+	const numHash = 2048
+	sig1 := randomSignature(numHash, 1)
+	for i, similarity := range []float64{0, 0.2, 0.5, 0.8, 1} {
+		// Make sig2 agree with sig1 at a fraction similarity of positions.
+		sig2 := randomSignature(numHash, int64(i+2))
+		copy(sig2, sig1[:int(similarity*numHash)])
+		expected, _ := EstimateJaccard(sig1, sig2)
+		for _, b := range []int{1, 2, 4, 8} {
+			packed1, _ := SigToBBit(sig1, b)
+			packed2, _ := SigToBBit(sig2, b)
+			j, err := EstimateJaccardBBit(packed1, packed2, b, numHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(j-expected) > 0.1 {
+				t.Fatalf("b = %d: expected about %.2f, got %.2f", b, expected, j)
+			}
+		}
+	}
+	packed, _ := SigToBBit(sig1, 1)
+	if _, err := EstimateJaccardBBit(packed, packed[1:], 1, numHash); err != ErrSignatureLength {
+		t.Fatal("expected error for signatures of different lengths")
+	}
+}
+
+func TestBBitEstimator(t *testing.T) {
+	if j := (MatchFraction{}).Estimate(3, 4); j != 0.75 {
+		t.Fatal(j)
+	}
+	// With 1 bit, half of the different hash values match.
+	if j := (BBitEstimator{1}).Estimate(3, 4); j != 0.5 {
+		t.Fatal(j)
+	}
+	if j := (BBitEstimator{1}).Estimate(1, 4); j != 0 {
+		t.Fatal(j)
+	}
+}
+
+func TestSigToHex(t *testing.T) {
+	sig := randomSignature(8, 1)
+	s := SigToHex(sig)
+	if len(s) != 8*16 {
+		t.Fatal(len(s))
+	}
+	decoded, err := HexToSig(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sig {
+		if decoded[i] != sig[i] {
+			t.Fatal("signature changed after round trip")
+		}
+	}
+	if sig, _ := HexToSig(SigToHex([]uint64{1})); sig[0] != 1 {
+		t.Fatal(sig)
+	}
+	if _, err := HexToSig("zz"); err == nil {
+		t.Fatal("expected error for malformed input")
+	}
+	if _, err := HexToSig(s[:14]); err == nil {
+		t.Fatal("expected error for misaligned input")
+	}
+}
+
+func TestTruncateSignature(t *testing.T) {
+	m := NewMinhash(1, 256)
+	for _, v := range data(100) {
+		m.Push(v)
+	}
+	sig := m.Signature()
+	truncated, err := TruncateSignature(sig, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same as a signature created with fewer hash functions.
+	m = NewMinhash(1, 128)
+	for _, v := range data(100) {
+		m.Push(v)
+	}
+	if j, _ := EstimateJaccard(truncated, m.Signature()); j != 1 {
+		t.Fatal("truncated signature differs from smaller signature")
+	}
+	truncated[0] = 0
+	if sig[0] == 0 {
+		t.Fatal("truncated signature should be a copy")
+	}
+	if _, err := TruncateSignature(sig, 257); err == nil {
+		t.Fatal("expected error for length larger than signature")
+	}
+	if _, err := TruncateSignature(sig, 0); err == nil {
+		t.Fatal("expected error for zero length")
+	}
+}
+
+func TestSigsToColumnar(t *testing.T) {
+	sigs := [][]uint64{{1, 2, 3}, {4, 5, 6}}
+	columns, err := SigsToColumnar(sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]uint64{{1, 4}, {2, 5}, {3, 6}}
+	if !reflect.DeepEqual(columns, expected) {
+		t.Fatal(columns)
+	}
+	roundTrip, err := ColumnarToSigs(columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTrip, sigs) {
+		t.Fatal(roundTrip)
+	}
+	if columns, err := SigsToColumnar(nil); err != nil || len(columns) != 0 {
+		t.Fatal(columns, err)
+	}
+	if _, err := SigsToColumnar([][]uint64{{1, 2}, {3}}); err != ErrSignatureLength {
+		t.Fatal("expected ErrSignatureLength for signatures of different lengths")
+	}
+	if _, err := ColumnarToSigs([][]uint64{{}}); err != ErrSignatureLength {
+		t.Fatal("expected ErrSignatureLength for empty columns")
+	}
+}
@@ -0,0 +1,115 @@
+package minhashlsh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// SignatureWriter writes a stream of signatures with their IDs.
+// Every record is framed by its length, so that a truncated stream
+// is detected by SignatureReader.
+type SignatureWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewSignatureWriter creates a SignatureWriter writing to w.
+// Every call to Write makes a single call to w.Write.
+func NewSignatureWriter(w io.Writer) *SignatureWriter {
+	return &SignatureWriter{w: w}
+}
+
+// Write writes a record of the ID and the signature.
+// The record consists of its length in bytes, the length of the ID and
+// the ID, the number of hash values and the hash values in 8 bytes little
+// endian order, all lengths are unsigned varints.
+func (sw *SignatureWriter) Write(id string, sig []uint64) error {
+	size := uvarintSize(uint64(len(id))) + len(id) + uvarintSize(uint64(len(sig))) + 8*len(sig)
+	b := appendUvarint(sw.buf[:0], uint64(size))
+	b = appendUvarint(b, uint64(len(id)))
+	b = append(b, id...)
+	b = appendUvarint(b, uint64(len(sig)))
+	start := len(b)
+	b = append(b, make([]byte, 8*len(sig))...)
+	putSigValues(b[start:], sig, 8)
+	sw.buf = b
+	_, err := sw.w.Write(b)
+	return err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func uvarintSize(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// SignatureReader reads a stream of signatures written by
+// SignatureWriter.
+type SignatureReader struct {
+	r *bufio.Reader
+}
+
+// NewSignatureReader creates a SignatureReader reading from r.
+func NewSignatureReader(r io.Reader) *SignatureReader {
+	return &SignatureReader{r: bufio.NewReader(r)}
+}
+
+var errCorruptedRecord = errors.New("Corrupted signature record")
+
+// Read reads the next record. It returns io.EOF when the stream ends
+// after a complete record, and io.ErrUnexpectedEOF when it ends in the
+// middle of a record. The lengths of a record are checked against its
+// length, and it is only allocated as it is read, so a corrupted length
+// is an error rather than an allocation failure.
+func (sr *SignatureReader) Read() (id string, sig []uint64, err error) {
+	// ReadUvarint returns io.EOF only if no byte is read.
+	size, err := binary.ReadUvarint(sr.r)
+	if err != nil {
+		return "", nil, err
+	}
+	br := newBinaryReader(sr.r, -1)
+	idSize := br.readUvarint()
+	if br.err != nil {
+		return "", nil, br.err
+	}
+	size, ok := subtractSize(size, uint64(uvarintSize(idSize)))
+	if ok {
+		size, ok = subtractSize(size, idSize)
+	}
+	if !ok || idSize > math.MaxInt32 {
+		return "", nil, errCorruptedRecord
+	}
+	id = string(br.read(int(idSize)))
+	sigSize := br.readUvarint()
+	if br.err != nil {
+		return "", nil, br.err
+	}
+	// The hash values are the rest of the record.
+	size, ok = subtractSize(size, uint64(uvarintSize(sigSize)))
+	if !ok || sigSize > math.MaxInt32/8 || size != sigSize*8 {
+		return "", nil, errCorruptedRecord
+	}
+	b := br.read(int(size))
+	if br.err != nil {
+		return "", nil, br.err
+	}
+	sig, err = BytesToSig(b)
+	return id, sig, err
+}
+
+// subtractSize returns the size left in a record after n bytes, and false
+// if the record is shorter.
+func subtractSize(size, n uint64) (uint64, bool) {
+	if n > size {
+		return 0, false
+	}
+	return size - n, true
+}
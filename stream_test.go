@@ -0,0 +1,66 @@
+package minhashlsh
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+)
+
+func TestSignatureWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSignatureWriter(&buf)
+	sigs := make([][]uint64, 10)
+	for i := range sigs {
+		sigs[i] = randomSignature(i*10, int64(i))
+		if err := w.Write(strconv.Itoa(i), sigs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+
+	r := NewSignatureReader(bytes.NewReader(data))
+	for i := range sigs {
+		id, sig, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != strconv.Itoa(i) || len(sig) != len(sigs[i]) {
+			t.Fatalf("record %d: unexpected ID %s or signature length %d", i, id, len(sig))
+		}
+		for j := range sig {
+			if sig[j] != sigs[i][j] {
+				t.Fatalf("record %d: signature changed", i)
+			}
+		}
+	}
+	if _, _, err := r.Read(); err != io.EOF {
+		t.Fatal("expected io.EOF at the end of stream, got", err)
+	}
+
+	// Truncated stream.
+	r = NewSignatureReader(bytes.NewReader(data[:len(data)-1]))
+	var err error
+	for err == nil {
+		_, _, err = r.Read()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF for truncated stream, got", err)
+	}
+
+	// Corrupted lengths.
+	for _, record := range [][]byte{
+		appendUvarint(appendUvarint(nil, 1<<62), 1<<61),
+		appendUvarint(appendUvarint(appendUvarint(nil, 1<<62), 0), 1<<61),
+		appendUvarint(appendUvarint(appendUvarint(nil, 9), 0), 2),
+	} {
+		if _, _, err := NewSignatureReader(bytes.NewReader(record)).Read(); err != errCorruptedRecord {
+			t.Fatal("expected errCorruptedRecord for corrupted lengths, got", err)
+		}
+	}
+	// A record length longer than the stream.
+	record := appendUvarint(appendUvarint(nil, 1<<30), 1<<30-uint64(uvarintSize(1<<30)))
+	if _, _, err := NewSignatureReader(bytes.NewReader(record)).Read(); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF for truncated record, got", err)
+	}
+}
@@ -0,0 +1,132 @@
+package minhashlsh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Validate checks the internal consistency of the index, and returns an
+// error describing the first violation found: every hash table has the
+// same number of entries and its indexed part is sorted, every key in the
+// index has exactly one entry per band for every time it was added, with
+// the hash keys recorded for it, no entry refers to a removed key, and
+// what is recorded about keys, such as stored signatures and aliases,
+// only refers to keys in the index having them. It takes O(total entries)
+// time and is meant for debugging. It must not be called concurrently
+// with other methods.
+func (f *MinhashLSH) Validate() error {
+	if len(f.hashTables) != f.l || len(f.locks) != f.l {
+		return fmt.Errorf("Expected %d hash tables, got %d", f.l, len(f.hashTables))
+	}
+	for i, table := range f.hashTables {
+		if len(table) != len(f.hashTables[0]) {
+			return fmt.Errorf("Band %d has %d entries, band 0 has %d", i, len(table), len(f.hashTables[0]))
+		}
+		if f.numIndexedKeys > len(table) {
+			return fmt.Errorf("Band %d has %d entries, fewer than the %d indexed", i, len(table), f.numIndexedKeys)
+		}
+		if !sort.IsSorted(table[:f.numIndexedKeys]) {
+			return fmt.Errorf("The indexed entries of band %d are not sorted", i)
+		}
+	}
+	for key, hashKeys := range f.members {
+		if len(hashKeys) == 0 || len(hashKeys)%f.l != 0 {
+			return fmt.Errorf("Key %v has %d hash keys, not a multiple of %d bands", key, len(hashKeys), f.l)
+		}
+	}
+	for i, table := range f.hashTables {
+		// The entries of the band not yet matched with the members.
+		unmatched := make(map[entry]int, len(table))
+		for _, e := range table {
+			if len(e.hashKey) != f.hashKeySize() {
+				return fmt.Errorf("Key %v has a hash key of %d bytes in band %d, expected %d",
+					e.key, len(e.hashKey), i, f.hashKeySize())
+			}
+			if _, exist := f.members[e.key]; !exist {
+				return fmt.Errorf("Band %d refers to key %v which is not in the index", i, e.key)
+			}
+			unmatched[e]++
+		}
+		for key, hashKeys := range f.members {
+			for j := i; j < len(hashKeys); j += f.l {
+				e := entry{hashKeys[j], key}
+				if unmatched[e] == 0 {
+					return fmt.Errorf("Key %v is missing an entry in band %d", key, i)
+				}
+				unmatched[e]--
+			}
+		}
+		for e, n := range unmatched {
+			if n != 0 {
+				return fmt.Errorf("Key %v has %d unrecorded entries in band %d", e.key, n, i)
+			}
+		}
+	}
+	for alias, key := range f.aliasOf {
+		if _, exist := f.members[alias]; exist {
+			return fmt.Errorf("Alias %v is also an indexed key", alias)
+		}
+		if _, exist := f.members[key]; !exist {
+			return fmt.Errorf("Alias %v refers to key %v which is not indexed", alias, key)
+		}
+		var found bool
+		for _, a := range f.aliases[key] {
+			found = found || a == alias
+		}
+		if !found {
+			return fmt.Errorf("Alias %v is not recorded for key %v", alias, key)
+		}
+	}
+	for sigKey, key := range f.sigOwners {
+		var found bool
+		hashKeys := f.members[key]
+		for i := 0; i+f.l <= len(hashKeys) && !found; i += f.l {
+			found = strings.Join(hashKeys[i:i+f.l], "") == sigKey
+		}
+		if !found {
+			return fmt.Errorf("Identical signatures are coalesced into key %v which does not have them", key)
+		}
+	}
+	for key, aliases := range f.aliases {
+		for _, alias := range aliases {
+			if f.aliasOf[alias] != key {
+				return fmt.Errorf("Key %v has alias %v of another key", key, alias)
+			}
+		}
+	}
+	for key := range f.signatures {
+		if !f.contains(key) {
+			return fmt.Errorf("Stored signature of key %v which is not in the index", key)
+		}
+	}
+	for key := range f.values {
+		if !f.contains(key) {
+			return fmt.Errorf("Value of key %v which is not in the index", key)
+		}
+	}
+	for key := range f.sizes {
+		if !f.contains(key) {
+			return fmt.Errorf("Size of key %v which is not in the index", key)
+		}
+	}
+	for key := range f.elements {
+		if !f.contains(key) {
+			return fmt.Errorf("Retained elements of key %v which is not in the index", key)
+		}
+	}
+	if f.lru != nil {
+		if f.lru.Len() != len(f.members) || len(f.lruElements) != len(f.members) {
+			return fmt.Errorf("Eviction order has %d keys, the index has %d", f.lru.Len(), len(f.members))
+		}
+		for key, e := range f.lruElements {
+			if e.Value != key {
+				return fmt.Errorf("Eviction order of key %v refers to key %v", key, e.Value)
+			}
+			if _, exist := f.members[key]; !exist {
+				return fmt.Errorf("Eviction order refers to key %v which is not in the index", key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package minhashlsh
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_MinhashLSHValidate(t *testing.T) {
+	f := NewMinhashLSH16(256, 0.6, 10, StoreSignatures())
+	sig := randomSignature(256, 1)
+	for i := 0; i < 10; i++ {
+		f.Add(i, randomSignature(256, int64(i)))
+	}
+	f.Add(0, sig)
+	f.Index()
+	f.Add(10, sig)
+	f.Remove(3)
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := f.Save(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry left behind by a removal.
+	f.hashTables[0] = append(f.hashTables[0], entry{f.hashTables[0][0].hashKey, 3})
+	if err := f.Validate(); err == nil {
+		t.Fatal("expected error for uneven bands")
+	}
+	for i := 1; i < len(f.hashTables); i++ {
+		f.hashTables[i] = append(f.hashTables[i], entry{f.hashTables[i][0].hashKey, 3})
+	}
+	if err := f.Validate(); err == nil {
+		t.Fatal("expected error for an entry of a removed key")
+	}
+}
+
+func Test_MinhashLSHValidateBounded(t *testing.T) {
+	f := NewMinhashLSHBounded(256, 0.6, 2)
+	for i := 0; i < 5; i++ {
+		f.Add(i, randomSignature(256, int64(i)))
+	}
+	f.Index()
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}